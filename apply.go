@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/flanksource/commons/console"
+	"github.com/flanksource/kommons/kustomize"
 	perrors "github.com/pkg/errors"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	v1 "k8s.io/api/core/v1"
@@ -14,6 +15,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
 )
 
 var (
@@ -210,6 +212,9 @@ func (c *Client) Apply(namespace string, objects ...runtime.Object) error {
 	if err != nil {
 		return err
 	}
+	// objects are resolved first so that they can be kustomized together in a single run
+	var clients []dynamic.ResourceInterface
+	var resolved []*unstructured.Unstructured
 	for _, obj := range objects {
 		if IsNil(obj) {
 			continue
@@ -240,18 +245,18 @@ func (c *Client) Apply(namespace string, objects ...runtime.Object) error {
 			}
 			return perrors.Wrapf(err, "failed to get dynamic client from %s", obj.GetObjectKind().GroupVersionKind())
 		}
+		clients = append(clients, client)
+		resolved = append(resolved, unstructuredObj)
+	}
 
-		if kustomize != nil {
-			kustomized, err := kustomize.Kustomize(namespace, unstructuredObj)
-			if err != nil {
-				return err
-			}
-			if len(kustomized) != 1 {
-				return fmt.Errorf("failed to kustomize %s, got %d objects back", GetName(unstructuredObj), len(kustomized))
-			}
-			unstructuredObj = kustomized[0].(*unstructured.Unstructured)
+	if kustomize != nil && len(resolved) > 0 {
+		if resolved, err = c.kustomizeAll(kustomize, namespace, resolved); err != nil {
+			return err
 		}
+	}
 
+	for i, unstructuredObj := range resolved {
+		client := clients[i]
 		if c.ApplyHook != nil {
 			c.ApplyHook(namespace, *unstructuredObj)
 		}
@@ -318,6 +323,53 @@ func (c *Client) Apply(namespace string, objects ...runtime.Object) error {
 	return nil
 }
 
+// CheckPatches reports the patches from GetKustomizePatches that did not match any object applied
+// since the last check, according to StrictPatches. The patches are shared by every Apply, so it
+// should be called once all objects have been applied, e.g. after a run with ApplyDryRun so that
+// nothing is changed if a patch is unmatched
+func (c *Client) CheckPatches() error {
+	kustomize, err := c.GetKustomize()
+	if err != nil {
+		return err
+	}
+	return kustomize.CheckPatches()
+}
+
+// kustomizeAll kustomizes objects in a single run, returning exactly one object for each input in the same order
+func (c *Client) kustomizeAll(km *kustomize.Manager, namespace string, objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var inputs []runtime.Object
+	for _, obj := range objects {
+		if c.IsDebugEnabled() {
+			c.debugPatches(km, namespace, obj)
+		}
+		inputs = append(inputs, obj)
+	}
+	kustomized, err := km.Kustomize(namespace, inputs...)
+	if err != nil {
+		return nil, err
+	}
+	if len(kustomized) != len(objects) {
+		return nil, fmt.Errorf("failed to kustomize %d objects, got %d objects back", len(objects), len(kustomized))
+	}
+	var results []*unstructured.Unstructured
+	for _, obj := range kustomized {
+		results = append(results, obj.(*unstructured.Unstructured))
+	}
+	return results, nil
+}
+
+// debugPatches logs each patch that targets obj, and the changes it makes
+func (c *Client) debugPatches(km *kustomize.Manager, namespace string, obj *unstructured.Unstructured) {
+	steps, err := km.PatchSteps(namespace, obj)
+	if err != nil {
+		c.Debugf("failed to trace patches for %s: %v", GetName(obj), err)
+		return
+	}
+	for _, step := range steps {
+		c.Debugf("%s patched by %s\n%s", GetName(obj), step.Patch.File, step.Diff())
+	}
+}
+
 func (c *Client) DeleteByKind(kind, namespace, name string) error {
 	client, err := c.GetClientByKind(kind)
 	if err != nil {
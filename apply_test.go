@@ -0,0 +1,60 @@
+package kommons
+
+import (
+	"testing"
+
+	"github.com/flanksource/commons/logger"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newDeployment(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": int64(1)},
+	}}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+func TestKustomizeAll(t *testing.T) {
+	c := &Client{
+		Logger: logger.StandardLogger(),
+		GetKustomizePatches: func() ([]string, error) {
+			return []string{`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 3
+`}, nil
+		},
+	}
+	km, err := c.GetKustomize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := []*unstructured.Unstructured{newDeployment("web"), newDeployment("api"), newDeployment("worker")}
+	kustomized, err := c.kustomizeAll(km, "default", objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kustomized) != 3 {
+		t.Fatalf("expected 3 objects, got %d", len(kustomized))
+	}
+	for i, name := range []string{"web", "api", "worker"} {
+		if kustomized[i].GetName() != name {
+			t.Errorf("expected %s at %d, got %s", name, i, kustomized[i].GetName())
+		}
+		expected := int64(1)
+		if name == "api" {
+			expected = 3
+		}
+		if replicas, _, _ := unstructured.NestedInt64(kustomized[i].Object, "spec", "replicas"); replicas != expected {
+			t.Errorf("%s: expected %d replicas, got %d", name, expected, replicas)
+		}
+	}
+}
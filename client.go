@@ -54,7 +54,11 @@ type Client struct {
 	GetKustomizePatches  func() ([]string, error)
 	ApplyDryRun          bool
 	ApplyHook            ApplyHook
+	AnnotatePatches      bool
+	StrictPatches        kustomize.StrictMode
 	ImmutableAnnotations []string
+	NodeCommandRunner    *NodeCommandRunner
+	StreamTransport      proxy.Transport
 	Trace                bool
 	client               *kubernetes.Clientset
 	dynamicClient        dynamic.Interface
@@ -160,11 +164,19 @@ func (c *Client) GetKustomize() (*kustomize.Manager, error) {
 
 	}
 	c.kustomizeManager = &kustomize.Manager{
-		FileSystem: fs,
+		FileSystem:      fs,
+		AnnotatePatches: c.AnnotatePatches,
+		Strict:          c.StrictPatches,
 	}
 	return c.kustomizeManager, err
 }
 
+// BuildKustomization builds the kustomization directory or overlay at path on disk,
+// patches from GetKustomizePatches are not applied until the objects are applied
+func (c *Client) BuildKustomization(path string) ([]*unstructured.Unstructured, error) {
+	return kustomize.Build(filesys.MakeFsOnDisk(), path)
+}
+
 // GetDynamicClient creates a new k8s client
 func (c *Client) GetDynamicClient() (dynamic.Interface, error) {
 	if c.dynamicClient != nil {
@@ -421,7 +433,38 @@ func (c *Client) GetProxyDialer(p proxy.Proxy) (*proxy.Dialer, error) {
 		return nil, err
 	}
 
-	return proxy.NewDialer(p, clientset, restConfig)
+	return proxy.NewDialer(p, clientset, restConfig, proxy.WithTransport(c.StreamTransport))
+}
+
+// GetProxyRoundTripper returns an http.RoundTripper for reaching in-cluster services
+// by URLs such as http://svc.namespace:port/, using the mode selected by p
+func (c *Client) GetProxyRoundTripper(p proxy.Proxy) (*proxy.RoundTripper, error) {
+	clientset, err := c.GetClientset()
+	if err != nil {
+		return nil, err
+	}
+
+	restConfig, err := c.GetRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy.NewRoundTripper(p, clientset, restConfig, proxy.WithTransport(c.StreamTransport))
+}
+
+// GetSOCKS5Server returns a SOCKS5 server that tunnels connections to cluster DNS names through port-forwarding
+func (c *Client) GetSOCKS5Server() (*proxy.SOCKS5Server, error) {
+	clientset, err := c.GetClientset()
+	if err != nil {
+		return nil, err
+	}
+
+	restConfig, err := c.GetRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy.NewSOCKS5Server(clientset, restConfig, proxy.WithTransport(c.StreamTransport)), nil
 }
 
 func (c *Client) Update(namespace string, item runtime.Object) error {
@@ -0,0 +1,248 @@
+package kommons
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// CopyToPod copies a local file or directory to dest inside a container, dest is
+// the full remote path of the copied file or directory. The container must have tar installed
+func (c *Client) CopyToPod(ctx context.Context, namespace, pod, container, src, dest string) error {
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("copyToPod: %v", err)
+	}
+	dest = path.Clean(dest)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, src, path.Base(dest))) // nolint: errcheck
+	}()
+	defer reader.Close()
+
+	var stderr bytes.Buffer
+	command := []string{"tar", "-xmf", "-", "-C", path.Dir(dest)}
+	err := c.Exec(ctx, ExecOptions{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Command:   command,
+		Stdin:     reader,
+		Stderr:    &stderr,
+	})
+	if err != nil {
+		return copyError(namespace, pod, container, err, &stderr)
+	}
+	c.Debugf("[%s/%s/%s] copied %s to %s", namespace, pod, container, src, dest)
+	return nil
+}
+
+// CopyFromPod copies the remote file or directory src inside a container to the local
+// path dest. The container must have tar installed
+func (c *Client) CopyFromPod(ctx context.Context, namespace, pod, container, src, dest string) error {
+	src = path.Clean(src)
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	var stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		err := c.Exec(ctx, ExecOptions{
+			Namespace: namespace,
+			Pod:       pod,
+			Container: container,
+			Command:   []string{"tar", "-cf", "-", "-C", path.Dir(src), path.Base(src)},
+			Stdout:    writer,
+			Stderr:    &stderr,
+		})
+		writer.CloseWithError(err) // nolint: errcheck
+		done <- err
+	}()
+
+	readErr := readTar(reader, path.Base(src), dest)
+	// drain any trailing padding so that the remote tar can exit
+	io.Copy(io.Discard, reader) // nolint: errcheck
+	if err := <-done; err != nil {
+		return copyError(namespace, pod, container, err, &stderr)
+	}
+	if readErr != nil {
+		return fmt.Errorf("copyFromPod: failed to extract %s: %v", src, readErr)
+	}
+	c.Debugf("[%s/%s/%s] copied %s to %s", namespace, pod, container, src, dest)
+	return nil
+}
+
+// copyError returns a descriptive error when tar is not available in the container
+func copyError(namespace, pod, container string, err error, stderr *bytes.Buffer) error {
+	var exitErr *ExitError
+	msg := safeString(stderr)
+	if (errors.As(err, &exitErr) && (exitErr.Code == 126 || exitErr.Code == 127)) ||
+		strings.Contains(err.Error(), "executable file not found") ||
+		strings.Contains(msg, "tar: not found") {
+		return fmt.Errorf("tar is not available in %s/%s/%s, it is required for copying files: %v", namespace, pod, container, err)
+	}
+	if msg != "" {
+		return fmt.Errorf("copy failed: %v: %s", err, strings.TrimSpace(msg))
+	}
+	return fmt.Errorf("copy failed: %v", err)
+}
+
+// writeTar writes the file or directory at src into a tar stream with its root renamed to name
+func writeTar(w io.Writer, src, name string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readTar extracts a tar stream whose root entry is name into dest, preserving file modes
+func readTar(r io.Reader, name, dest string) error {
+	tr := tar.NewReader(r)
+	found := false
+	// directory modes are applied last so that read-only directories can still be populated
+	dirs := map[string]os.FileMode{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entry := path.Clean(header.Name)
+		if entry != name && !strings.HasPrefix(entry, name+"/") {
+			return fmt.Errorf("unexpected entry %s in archive", header.Name)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(entry, name), "/")
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("illegal path %s in archive", header.Name)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		found = true
+		// symlinks extracted earlier must not redirect later entries outside of dest
+		if err := checkNoSymlinks(dest, rel); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs[target] = mode
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			link := filepath.FromSlash(header.Linkname)
+			if filepath.IsAbs(link) || path.IsAbs(header.Linkname) {
+				return fmt.Errorf("illegal symlink %s to absolute path %s in archive", header.Name, header.Linkname)
+			}
+			if !isWithin(dest, filepath.Join(filepath.Dir(target), link)) {
+				return fmt.Errorf("illegal symlink %s to %s outside of %s in archive", header.Name, header.Linkname, dest)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s not found", name)
+	}
+	for dir, mode := range dirs {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNoSymlinks returns an error if dest/rel, or any directory between dest and it, is a symlink
+func checkNoSymlinks(dest, rel string) error {
+	current := dest
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal path %s in archive: %s is a symlink", rel, current)
+		}
+	}
+	return nil
+}
+
+// isWithin returns true if target is dir or inside it
+func isWithin(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,138 @@
+package kommons
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "conf", "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "conf", "run.sh"), []byte("#!/bin/sh\necho hi\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "conf", "nested", "app.yaml"), []byte("key: value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, filepath.Join(src, "conf"), "config")) // nolint: errcheck
+	}()
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := readTar(reader, "config", dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, mode := range map[string]os.FileMode{"run.sh": 0750, "nested/app.yaml": 0600} {
+		info, err := os.Stat(filepath.Join(dest, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s: expected mode %v, got %v", file, mode, info.Mode().Perm())
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "nested", "app.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "key: value\n" {
+		t.Errorf("unexpected content %q", string(data))
+	}
+}
+
+func TestTarSingleFile(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "backup.sql")
+	if err := os.WriteFile(src, []byte("select 1;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, src, "dump.sql")) // nolint: errcheck
+	}()
+	dest := filepath.Join(t.TempDir(), "local.sql")
+	if err := readTar(reader, "dump.sql", dest); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "select 1;" {
+		t.Errorf("unexpected content %q", string(data))
+	}
+}
+
+func TestTarRejectsSymlinkEscapes(t *testing.T) {
+	type entry struct {
+		name, link, content string
+	}
+	tests := map[string][]entry{
+		"absolute link":        {{name: "config/etc", link: "/etc"}},
+		"link outside of dest": {{name: "config/up", link: "../../outside"}},
+		"write through link":   {{name: "config/dir", link: "."}, {name: "config/dir/evil", content: "x"}},
+		"nested link escape":   {{name: "config/a/b", link: "../../.."}, {name: "config/a/b/evil", content: "x"}},
+	}
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, e := range entries {
+				header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+				if e.link != "" {
+					header = &tar.Header{Name: e.name, Linkname: e.link, Mode: 0777, Typeflag: tar.TypeSymlink}
+				}
+				if err := tw.WriteHeader(header); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write([]byte(e.content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			root := t.TempDir()
+			dest := filepath.Join(root, "restored")
+			if err := readTar(&buf, "config", dest); err == nil {
+				t.Fatal("expected the archive to be rejected")
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+				t.Error("a file was written outside of dest")
+			}
+		})
+	}
+}
+
+func TestTarRelativeSymlink(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "config/app.yaml", Mode: 0644, Typeflag: tar.TypeReg, Size: 2},
+		{Name: "config/current.yaml", Linkname: "app.yaml", Mode: 0777, Typeflag: tar.TypeSymlink},
+	} {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte("a\n")) // nolint: errcheck
+		}
+	}
+	tw.Close() // nolint: errcheck
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := readTar(&buf, "config", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "current.yaml")); err != nil || string(data) != "a\n" {
+		t.Errorf("expected the symlink to be extracted, got %q %v", data, err)
+	}
+}
@@ -3,105 +3,373 @@ package kommons
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
+	"sync"
 	"time"
 
 	utils "github.com/flanksource/commons/utils"
+	"github.com/flanksource/kommons/proxy"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
 )
 
-// ExecutePodf runs the specified shell command inside a container of the specified pod
-func (c *Client) ExecutePodf(namespace, pod, container string, command ...string) (string, string, error) {
+// ExecOptions describes the command and streams attached to an Exec call
+type ExecOptions struct {
+	Namespace string
+	Pod       string
+	Container string
+	Command   []string
+
+	// Stdin, Stdout and Stderr are attached to the remote process when set
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// TTY allocates a terminal for the remote process, stderr is merged into stdout
+	TTY bool
+
+	// TerminalSizeQueue is polled for resize events when TTY is set
+	TerminalSizeQueue remotecommand.TerminalSizeQueue
+}
+
+// ExitError is returned when the remote command completes with a non-zero exit code
+type ExitError struct {
+	Command []string
+	Code    int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command %v terminated with exit code %d", e.Command, e.Code)
+}
+
+// ExitStatus returns the remote exit code
+func (e *ExitError) ExitStatus() int {
+	return e.Code
+}
+
+// TerminalSizes is a TerminalSizeQueue fed by a channel, closing the channel
+// stops resize handling
+type TerminalSizes chan remotecommand.TerminalSize
+
+// Next blocks until the next terminal size is available
+func (t TerminalSizes) Next() *remotecommand.TerminalSize {
+	size, ok := <-t
+	if !ok {
+		return nil
+	}
+	return &size
+}
+
+// Exec runs a command inside a container, streaming stdin, stdout and stderr.
+// A non-zero remote exit code is returned as an *ExitError
+func (c *Client) Exec(ctx context.Context, opts ExecOptions) error {
 	client, err := c.GetClientset()
 	if err != nil {
-		return "", "", fmt.Errorf("executePodf: Failed to get clientset: %v", err)
+		return fmt.Errorf("exec: Failed to get clientset: %v", err)
 	}
-	c.Debugf("[%s/%s/%s] %s", namespace, pod, container, command)
-	const tty = false
+	c.Debugf("[%s/%s/%s] %s", opts.Namespace, opts.Pod, opts.Container, opts.Command)
 	req := client.CoreV1().RESTClient().Post().
 		Resource("pods").
-		Name(pod).
-		Namespace(namespace).
+		Name(opts.Pod).
+		Namespace(opts.Namespace).
 		SubResource("exec").
-		Param("container", container)
+		Param("container", opts.Container)
 	req.VersionedParams(&v1.PodExecOptions{
-		Container: container,
-		Command:   command,
-		Stdin:     false,
-		Stdout:    true,
-		Stderr:    true,
-		TTY:       tty,
+		Container: opts.Container,
+		Command:   opts.Command,
+		Stdin:     opts.Stdin != nil,
+		Stdout:    opts.Stdout != nil,
+		Stderr:    opts.Stderr != nil && !opts.TTY,
+		TTY:       opts.TTY,
 	}, scheme.ParameterCodec)
 
 	rc, err := c.GetRESTConfig()
 	if err != nil {
-		return "", "", fmt.Errorf("ExecutePodf: Failed to get REST config: %v", err)
+		return fmt.Errorf("exec: Failed to get REST config: %v", err)
 	}
 
-	exec, err := remotecommand.NewSPDYExecutor(rc, "POST", req.URL())
+	executor, err := c.newExecutor(rc, req.URL())
 	if err != nil {
-		return "", "", fmt.Errorf("ExecutePodf: Failed to get SPDY Executor: %v", err)
+		return fmt.Errorf("exec: Failed to get Executor: %v", err)
+	}
+	streamOptions := remotecommand.StreamOptions{
+		Stdin:  opts.Stdin,
+		Stdout: opts.Stdout,
+		Tty:    opts.TTY,
+	}
+	if !opts.TTY {
+		streamOptions.Stderr = opts.Stderr
+	} else {
+		streamOptions.TerminalSizeQueue = opts.TerminalSizeQueue
+	}
+	return asExitError(opts.Command, executor.StreamWithContext(ctx, streamOptions))
+}
+
+// newExecutor returns a remote command executor using the client's StreamTransport
+func (c *Client) newExecutor(rc *rest.Config, u *url.URL) (remotecommand.Executor, error) {
+	switch c.StreamTransport {
+	case proxy.TransportWebSocket:
+		return remotecommand.NewWebSocketExecutor(rc, "GET", u.String())
+	case proxy.TransportAuto:
+		websocket, err := remotecommand.NewWebSocketExecutor(rc, "GET", u.String())
+		if err != nil {
+			return nil, err
+		}
+		spdy, err := remotecommand.NewSPDYExecutor(rc, "POST", u)
+		if err != nil {
+			return nil, err
+		}
+		return remotecommand.NewFallbackExecutor(websocket, spdy, proxy.ShouldFallback)
 	}
+	return remotecommand.NewSPDYExecutor(rc, "POST", u)
+}
+
+// asExitError converts the exit code reported by the remote executor into an *ExitError
+func asExitError(command []string, err error) error {
+	var exitErr exec.ExitError
+	if err != nil && errors.As(err, &exitErr) && exitErr.Exited() {
+		return &ExitError{Command: command, Code: exitErr.ExitStatus()}
+	}
+	return err
+}
+
+// ExecutePodf runs the specified shell command inside a container of the specified pod
+func (c *Client) ExecutePodf(namespace, pod, container string, command ...string) (string, string, error) {
 	var stdout, stderr bytes.Buffer
-	err = exec.Stream(remotecommand.StreamOptions{
-		Stdin:  nil,
-		Stdout: &stdout,
-		Stderr: &stderr,
-		Tty:    tty,
+	err := c.Exec(context.TODO(), ExecOptions{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Command:   command,
+		Stdout:    &stdout,
+		Stderr:    &stderr,
 	})
 
 	_stdout := safeString(&stdout)
 	_stderr := safeString(&stderr)
 	if err != nil {
-		return _stdout, _stderr, fmt.Errorf("exec returned an error: %+v", err)
+		return _stdout, _stderr, fmt.Errorf("exec returned an error: %w", err)
 	}
 
 	c.Tracef("[%s/%s/%s] %s => %s %s ", namespace, pod, container, command, _stdout, _stderr)
 	return _stdout, _stderr, nil
 }
 
+// NodeCommandRunner configures how Executef runs commands on a node
+type NodeCommandRunner struct {
+	// Image is the image used to run commands, defaults to docker.io/ubuntu:18.04
+	Image string
+	// Namespace is where command pods are created, defaults to kube-system
+	Namespace string
+	// ImagePullSecrets are added to command pods to pull Image from private registries. They are not
+	// used by ephemeral containers, which pull Image with the pull secrets of the pod they are attached to
+	ImagePullSecrets []string
+	// Shell is the shell on the node used to run the command after chroot, defaults to bash
+	Shell string
+	// Resources are applied to the command container, they cannot be set with Ephemeral
+	// as the API server rejects resources on ephemeral containers
+	Resources v1.ResourceRequirements
+	// Ephemeral runs the command in an ephemeral debug container attached to an existing
+	// pod on the node instead of creating a new pod. The target pod must use the host PID namespace
+	Ephemeral bool
+	// EphemeralTargetSelector selects the pod in Namespace that ephemeral containers are attached to
+	EphemeralTargetSelector string
+}
+
+// DefaultNodeCommandRunner is used by Executef when Client.NodeCommandRunner is not set
+var DefaultNodeCommandRunner = NodeCommandRunner{
+	Image:     "docker.io/ubuntu:18.04",
+	Namespace: "kube-system",
+	Shell:     "bash",
+}
+
+func (r NodeCommandRunner) withDefaults() NodeCommandRunner {
+	if r.Image == "" {
+		r.Image = DefaultNodeCommandRunner.Image
+	}
+	if r.Namespace == "" {
+		r.Namespace = DefaultNodeCommandRunner.Namespace
+	}
+	if r.Shell == "" {
+		r.Shell = DefaultNodeCommandRunner.Shell
+	}
+	return r
+}
+
+func (c *Client) getNodeCommandRunner() NodeCommandRunner {
+	if c.NodeCommandRunner == nil {
+		return DefaultNodeCommandRunner
+	}
+	return c.NodeCommandRunner.withDefaults()
+}
+
 // Executef runs the specified shell command on a node by creating
 // a pre-scheduled pod that runs in the host namespace
 func (c *Client) Executef(node string, timeout time.Duration, command string, args ...interface{}) (string, error) {
+	return c.ExecutefV2(context.TODO(), node, timeout, command, args...)
+}
+
+// ExecutefV2 is Executef that stops waiting for the command once ctx is cancelled, the command pod is still removed
+func (c *Client) ExecutefV2(ctx context.Context, node string, timeout time.Duration, command string, args ...interface{}) (string, error) {
+	runner := c.getNodeCommandRunner()
+	command = fmt.Sprintf(command, args...)
+	if runner.Ephemeral {
+		return c.executeEphemeral(ctx, runner, node, timeout, command)
+	}
 	client, err := c.GetClientset()
 	if err != nil {
 		return "", fmt.Errorf("executef: Failed to get clientset: %v", err)
 	}
-	pods := client.CoreV1().Pods("kube-system")
-	command = fmt.Sprintf(command, args...)
-	pod, err := pods.Create(context.TODO(), &v1.Pod{
+	pods := client.CoreV1().Pods(runner.Namespace)
+	pod, err := pods.Create(ctx, &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: fmt.Sprintf("command-%s-%s", node, utils.ShortTimestamp()),
 		},
-		Spec: NewCommandJob(node, command),
+		Spec: runner.PodSpec(node, command),
 	}, metav1.CreateOptions{})
-	c.Tracef("[%s] executing '%s' in pod %s", node, command, pod.Name)
 	if err != nil {
 		return "", fmt.Errorf("executef: Failed to create pod: %v", err)
 	}
-	defer pods.Delete(context.TODO(), pod.ObjectMeta.Name, metav1.DeleteOptions{}) // nolint: errcheck
+	// the pod is always removed, regardless of whether the command or log retrieval fails
+	defer pods.Delete(context.Background(), pod.Name, metav1.DeleteOptions{}) // nolint: errcheck
+	c.Tracef("[%s] executing '%s' in pod %s/%s", node, command, runner.Namespace, pod.Name)
 
-	logs := pods.GetLogs(pod.Name, &v1.PodLogOptions{
+	err = c.waitForPod(ctx, runner.Namespace, pod.Name, timeout, v1.PodSucceeded)
+	logString := read(ctx, pods.GetLogs(pod.Name, &v1.PodLogOptions{
 		Container: pod.Spec.Containers[0].Name,
+	}))
+	if err != nil {
+		return logString, fmt.Errorf("failed to execute command, pod did not complete: %w", err)
+	}
+	c.Tracef("[%s] stdout: %s", node, logString)
+	return logString, nil
+}
+
+// executeEphemeral runs a command in an ephemeral container attached to a host PID pod on the node
+func (c *Client) executeEphemeral(ctx context.Context, runner NodeCommandRunner, node string, timeout time.Duration, command string) (string, error) {
+	if err := runner.validateEphemeral(); err != nil {
+		return "", err
+	}
+	client, err := c.GetClientset()
+	if err != nil {
+		return "", fmt.Errorf("executef: Failed to get clientset: %v", err)
+	}
+	pods := client.CoreV1().Pods(runner.Namespace)
+	list, err := pods.List(ctx, metav1.ListOptions{
+		LabelSelector: runner.EphemeralTargetSelector,
+		FieldSelector: "spec.nodeName=" + node,
 	})
+	if err != nil {
+		return "", fmt.Errorf("executef: Failed to list pods on %s: %v", node, err)
+	}
+	var target *v1.Pod
+	for i := range list.Items {
+		if list.Items[i].Spec.HostPID && list.Items[i].Status.Phase == v1.PodRunning {
+			target = &list.Items[i]
+			break
+		}
+	}
+	if target == nil {
+		return "", fmt.Errorf("executef: no running pod with hostPID found on %s in %s matching %q", node, runner.Namespace, runner.EphemeralTargetSelector)
+	}
 
-	err = c.WaitForPod("kube-system", pod.ObjectMeta.Name, timeout, v1.PodSucceeded)
-	logString := read(logs)
+	container := runner.container(command, "/proc/1/root")
+	container.Name = fmt.Sprintf("command-%s", utils.ShortTimestamp())
+	target.Spec.EphemeralContainers = append(target.Spec.EphemeralContainers, v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon(container),
+	})
+	if _, err := pods.UpdateEphemeralContainers(ctx, target.Name, target, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("executef: Failed to add ephemeral container to %s: %v", target.Name, err)
+	}
+	c.Tracef("[%s] executing '%s' in ephemeral container %s/%s/%s", node, command, runner.Namespace, target.Name, container.Name)
+
+	err = c.waitForEphemeralContainer(ctx, runner.Namespace, target.Name, container.Name, timeout)
+	logString := read(ctx, pods.GetLogs(target.Name, &v1.PodLogOptions{
+		Container: container.Name,
+	}))
 	if err != nil {
-		return logString, fmt.Errorf("failed to execute command, pod did not complete: %v", err)
+		return logString, fmt.Errorf("failed to execute command, ephemeral container did not complete: %w", err)
 	}
 	c.Tracef("[%s] stdout: %s", node, logString)
 	return logString, nil
 }
 
-func NewCommandJob(node, command string) v1.PodSpec {
+// validateEphemeral returns an error for settings that ephemeral containers do not support
+func (r NodeCommandRunner) validateEphemeral() error {
+	if len(r.Resources.Limits) > 0 || len(r.Resources.Requests) > 0 || len(r.Resources.Claims) > 0 {
+		return fmt.Errorf("executef: Resources cannot be set for ephemeral containers")
+	}
+	return nil
+}
+
+func (c *Client) waitForEphemeralContainer(ctx context.Context, ns, pod, container string, timeout time.Duration) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	for {
+		p, err := client.CoreV1().Pods(ns).Get(ctx, pod, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, status := range p.Status.EphemeralContainerStatuses {
+			if status.Name != container || status.State.Terminated == nil {
+				continue
+			}
+			if status.State.Terminated.ExitCode != 0 {
+				return &ExitError{Code: int(status.State.Terminated.ExitCode)}
+			}
+			return nil
+		}
+		if start.Add(timeout).Before(time.Now()) {
+			return fmt.Errorf("timeout exceeded waiting for %s/%s", pod, container)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// container returns a privileged container that runs command chrooted into root
+func (r NodeCommandRunner) container(command, root string) v1.Container {
 	yes := true
+	return v1.Container{
+		Name:      "shell",
+		Image:     r.Image,
+		Command:   []string{"chroot", root, r.Shell, "-c", command},
+		Resources: r.Resources,
+		SecurityContext: &v1.SecurityContext{
+			Privileged: &yes,
+		},
+	}
+}
+
+// PodSpec returns a pod spec that runs command on node in the host namespaces
+func (r NodeCommandRunner) PodSpec(node, command string) v1.PodSpec {
+	r = r.withDefaults()
+	container := r.container(command, "/chroot")
+	container.VolumeMounts = []v1.VolumeMount{{
+		Name:      "root",
+		MountPath: "/chroot",
+	}}
+	var pullSecrets []v1.LocalObjectReference
+	for _, secret := range r.ImagePullSecrets {
+		pullSecrets = append(pullSecrets, v1.LocalObjectReference{Name: secret})
+	}
 	return v1.PodSpec{
-		RestartPolicy: v1.RestartPolicyNever,
-		NodeName:      node,
+		RestartPolicy:    v1.RestartPolicyNever,
+		NodeName:         node,
+		ImagePullSecrets: pullSecrets,
 		Volumes: []v1.Volume{{
 			Name: "root",
 			VolumeSource: v1.VolumeSource{
@@ -110,22 +378,7 @@ func NewCommandJob(node, command string) v1.PodSpec {
 				},
 			},
 		}},
-		Containers: []v1.Container{{
-			Name:  "shell",
-			Image: "docker.io/ubuntu:18.04",
-			Command: []string{
-				"sh",
-				"-c",
-				"chroot /chroot bash -c \"" + command + "\"",
-			},
-			VolumeMounts: []v1.VolumeMount{{
-				Name:      "root",
-				MountPath: "/chroot",
-			}},
-			SecurityContext: &v1.SecurityContext{
-				Privileged: &yes,
-			},
-		}},
+		Containers: []v1.Container{container},
 		Tolerations: []v1.Toleration{
 			{
 				// tolerate all values
@@ -137,3 +390,131 @@ func NewCommandJob(node, command string) v1.PodSpec {
 		HostIPC:     true,
 	}
 }
+
+func NewCommandJob(node, command string) v1.PodSpec {
+	return DefaultNodeCommandRunner.PodSpec(node, command)
+}
+
+// PodExecResult is the outcome of running a command in a single pod
+type PodExecResult struct {
+	Pod    string
+	Stdout string
+	Stderr string
+	// ExitCode is the remote exit code, or -1 if the command could not be run
+	ExitCode int
+	Err      error
+}
+
+// NodeExecResult is the outcome of running a command on a single node
+type NodeExecResult struct {
+	Node   string
+	Output string
+	Err    error
+}
+
+// ExecutePodsf runs a command in the container of every running pod matching labelSelector,
+// with at most concurrency commands in flight. Results are returned in the order the pods were listed
+func (c *Client) ExecutePodsf(ctx context.Context, namespace, labelSelector, container string, concurrency int, command ...string) ([]PodExecResult, error) {
+	client, err := c.GetClientset()
+	if err != nil {
+		return nil, fmt.Errorf("ExecutePodsf: Failed to get clientset: %v", err)
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ExecutePodsf: Failed to list pods for %v in namespace %v: %v", labelSelector, namespace, err)
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && !IsDeleted(&pod) {
+			names = append(names, pod.Name)
+		}
+	}
+
+	results := make([]PodExecResult, len(names))
+	forEachParallel(len(names), concurrency, func(i int) {
+		var stdout, stderr bytes.Buffer
+		err := c.Exec(ctx, ExecOptions{
+			Namespace: namespace,
+			Pod:       names[i],
+			Container: container,
+			Command:   command,
+			Stdout:    &stdout,
+			Stderr:    &stderr,
+		})
+		results[i] = PodExecResult{
+			Pod:      names[i],
+			Stdout:   safeString(&stdout),
+			Stderr:   safeString(&stderr),
+			ExitCode: exitCode(err),
+			Err:      err,
+		}
+	})
+	return results, nil
+}
+
+// ExecuteNodesf runs a command via ExecutefV2 on every node matching labelSelector,
+// with at most concurrency commands in flight. Results are returned in the order the nodes were listed.
+// Once ctx is cancelled no more commands are started and running commands stop waiting,
+// the result for each remaining node has ctx's error
+func (c *Client) ExecuteNodesf(ctx context.Context, labelSelector string, concurrency int, timeout time.Duration, command string, args ...interface{}) ([]NodeExecResult, error) {
+	client, err := c.GetClientset()
+	if err != nil {
+		return nil, fmt.Errorf("ExecuteNodesf: Failed to get clientset: %v", err)
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ExecuteNodesf: Failed to list nodes for %v: %v", labelSelector, err)
+	}
+
+	results := make([]NodeExecResult, len(nodes.Items))
+	forEachParallel(len(nodes.Items), concurrency, func(i int) {
+		node := nodes.Items[i].Name
+		if err := ctx.Err(); err != nil {
+			results[i] = NodeExecResult{Node: node, Err: err}
+			return
+		}
+		output, err := c.ExecutefV2(ctx, node, timeout, command, args...)
+		results[i] = NodeExecResult{
+			Node:   node,
+			Output: output,
+			Err:    err,
+		}
+	})
+	return results, nil
+}
+
+// exitCode returns the remote exit code for an error returned by Exec
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return -1
+}
+
+// forEachParallel calls fn for each index in [0, n) with at most concurrency calls
+// running at once, a concurrency of 0 or less runs all calls at once
+func forEachParallel(n, concurrency int, fn func(i int)) {
+	if concurrency <= 0 || concurrency > n {
+		concurrency = n
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,182 @@
+package kommons
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/kommons/proxy"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+func TestAsExitError(t *testing.T) {
+	err := asExitError([]string{"false"}, exec.CodeExitError{Err: fmt.Errorf("command terminated with exit code 3"), Code: 3})
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected *ExitError, got %T", err)
+	}
+	if exitErr.ExitStatus() != 3 {
+		t.Errorf("expected exit code 3, got %d", exitErr.ExitStatus())
+	}
+
+	other := fmt.Errorf("connection refused")
+	if asExitError(nil, other) != other {
+		t.Errorf("expected non exit errors to be returned unchanged")
+	}
+	if asExitError(nil, nil) != nil {
+		t.Errorf("expected nil error")
+	}
+}
+
+func TestTerminalSizes(t *testing.T) {
+	sizes := make(TerminalSizes, 1)
+	sizes <- remotecommand.TerminalSize{Width: 80, Height: 24}
+	if size := sizes.Next(); size == nil || size.Width != 80 || size.Height != 24 {
+		t.Errorf("unexpected size %v", size)
+	}
+	close(sizes)
+	if size := sizes.Next(); size != nil {
+		t.Errorf("expected nil after close, got %v", size)
+	}
+}
+
+func TestForEachParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	seen := make([]bool, 10)
+	forEachParallel(len(seen), 3, func(i int) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		seen[i] = true
+		mu.Unlock()
+	})
+	if peak > 3 {
+		t.Errorf("expected at most 3 concurrent calls, got %d", peak)
+	}
+	for i, ok := range seen {
+		if !ok {
+			t.Errorf("index %d was not visited", i)
+		}
+	}
+	forEachParallel(0, 0, func(i int) { t.Errorf("unexpected call %d", i) })
+}
+
+func TestExitCode(t *testing.T) {
+	if code := exitCode(nil); code != 0 {
+		t.Errorf("expected 0, got %d", code)
+	}
+	if code := exitCode(fmt.Errorf("exec returned an error: %w", &ExitError{Code: 2})); code != 2 {
+		t.Errorf("expected 2, got %d", code)
+	}
+	if code := exitCode(fmt.Errorf("dial failed")); code != -1 {
+		t.Errorf("expected -1, got %d", code)
+	}
+}
+
+func TestNodeCommandRunnerPodSpec(t *testing.T) {
+	spec := NodeCommandRunner{
+		Image:            "registry.local/tools:1.0",
+		ImagePullSecrets: []string{"registry"},
+		Shell:            "sh",
+	}.PodSpec("node-1", "uptime")
+
+	if spec.NodeName != "node-1" {
+		t.Errorf("expected node-1, got %s", spec.NodeName)
+	}
+	container := spec.Containers[0]
+	if container.Image != "registry.local/tools:1.0" {
+		t.Errorf("unexpected image %s", container.Image)
+	}
+	if fmt.Sprint(container.Command) != "[chroot /chroot sh -c uptime]" {
+		t.Errorf("unexpected command %v", container.Command)
+	}
+	if len(spec.ImagePullSecrets) != 1 || spec.ImagePullSecrets[0].Name != "registry" {
+		t.Errorf("unexpected pull secrets %v", spec.ImagePullSecrets)
+	}
+
+	defaults := NewCommandJob("node-2", "uptime")
+	if defaults.Containers[0].Image != DefaultNodeCommandRunner.Image {
+		t.Errorf("unexpected default image %s", defaults.Containers[0].Image)
+	}
+	if defaults.Containers[0].Command[2] != "bash" {
+		t.Errorf("unexpected default shell %s", defaults.Containers[0].Command[2])
+	}
+}
+
+func TestNodeCommandRunnerEphemeral(t *testing.T) {
+	runner := NodeCommandRunner{Ephemeral: true, ImagePullSecrets: []string{"registry"}}
+	if err := runner.validateEphemeral(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	runner.Resources.Limits = v1.ResourceList{v1.ResourceMemory: resource.MustParse("64Mi")}
+	if err := runner.validateEphemeral(); err == nil {
+		t.Error("expected resources to be rejected for ephemeral containers")
+	}
+}
+
+func TestNewExecutor(t *testing.T) {
+	u, _ := url.Parse("https://127.0.0.1:6443/api/v1/namespaces/default/pods/web/exec")
+	for _, transport := range []proxy.Transport{"", proxy.TransportSPDY, proxy.TransportWebSocket, proxy.TransportAuto} {
+		c := &Client{StreamTransport: transport}
+		executor, err := c.newExecutor(&rest.Config{Host: "https://127.0.0.1:6443"}, u)
+		if err != nil || executor == nil {
+			t.Errorf("%s: failed to create executor: %v", transport, err)
+		}
+	}
+}
+
+func TestExecuteNodesfCancel(t *testing.T) {
+	var deleted int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/v1/nodes":
+			io.WriteString(w, `{"kind":"NodeList","apiVersion":"v1","items":[{"metadata":{"name":"node-1"}}]}`) // nolint: errcheck
+		case r.Method == http.MethodDelete:
+			atomic.AddInt32(&deleted, 1)
+			io.WriteString(w, `{"kind":"Status","apiVersion":"v1","status":"Success"}`) // nolint: errcheck
+		default:
+			// the command pod never completes
+			io.WriteString(w, `{"kind":"Pod","apiVersion":"v1","metadata":{"name":"command-node-1"},"spec":{"containers":[{"name":"command"}]},"status":{"phase":"Pending"}}`) // nolint: errcheck
+		}
+	}))
+	defer apiServer.Close()
+
+	c := NewClient(&rest.Config{Host: apiServer.URL}, logger.StandardLogger())
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results, err := c.ExecuteNodesf(ctx, "", 1, time.Minute, "uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("running command was not stopped by the context, took %v", time.Since(start))
+	}
+	if len(results) != 1 || !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("expected the context's error, got %+v", results)
+	}
+	if atomic.LoadInt32(&deleted) != 1 {
+		t.Errorf("expected the command pod to be deleted")
+	}
+}
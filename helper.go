@@ -61,8 +61,8 @@ func (c *Client) decodeProtobufResource(kind string, object runtime.Object, mess
 	return nil, perrors.Errorf("failed to decode protobuf message into runtime object, failed to find any suitable gvk")
 }
 
-func read(req *rest.Request) string {
-	stream, err := req.Stream(context.TODO())
+func read(ctx context.Context, req *rest.Request) string {
+	stream, err := req.Stream(ctx)
 	if err != nil {
 		return fmt.Sprintf("Failed to stream logs %v", err)
 	}
@@ -0,0 +1,201 @@
+package ktemplate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Dependency is an object, or a list of objects, that was looked up during a render
+type Dependency struct {
+	Resource  schema.GroupVersionResource
+	Namespace string
+	// Name is empty for lists
+	Name          string
+	LabelSelector string
+	FieldSelector string
+	// ResourceVersion is the version of the object or list when it was read,
+	// it is empty if the object was not found
+	ResourceVersion string
+}
+
+func (d Dependency) key() string {
+	if d.Name != "" {
+		return fmt.Sprintf("%s/%s/%s", d.Resource, d.Namespace, d.Name)
+	}
+	return fmt.Sprintf("%s/%s?labels=%s&fields=%s", d.Resource, d.Namespace, d.LabelSelector, d.FieldSelector)
+}
+
+// lookup is the result of a get or list
+type lookup struct {
+	dependency Dependency
+	object     *unstructured.Unstructured
+	list       *unstructured.UnstructuredList
+	err        error
+}
+
+// LookupCache is a cache of lookups that can be shared by multiple Functions, so that
+// objects are not read again for each render until the TTL expires
+type LookupCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	lookup  lookup
+	expires time.Time
+}
+
+// NewLookupCache creates a cache whose entries expire after ttl
+func NewLookupCache(ttl time.Duration) *LookupCache {
+	return &LookupCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (c *LookupCache) get(key string) (lookup, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return lookup{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return lookup{}, false
+	}
+	return entry.lookup, true
+}
+
+func (c *LookupCache) set(key string, l lookup) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = cacheEntry{lookup: l, expires: time.Now().Add(c.ttl)}
+}
+
+// renderLookups are the objects and lists looked up during a render, so that each is read at most
+// once, and the dependencies they record
+type renderLookups struct {
+	lock         sync.Mutex
+	lookups      map[string]lookup
+	dependencies []Dependency
+}
+
+// Reset starts a new render, clearing the objects cached for the previous render and its dependencies
+func (f *Functions) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.current = &renderLookups{}
+}
+
+// currentLookups returns the lookups of the current render
+func (f *Functions) currentLookups() *renderLookups {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.current == nil {
+		f.current = &renderLookups{}
+	}
+	return f.current
+}
+
+// Dependencies returns the objects and lists looked up since the last Reset, in the order they were first used.
+// After concurrent calls to Template, these are the dependencies of the last call to finish
+func (f *Functions) Dependencies() []Dependency {
+	r := f.currentLookups()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Dependency(nil), r.dependencies...)
+}
+
+// getObject returns an object, reading it at most once per render
+func (f *Functions) getObject(r *renderLookups, kind, namespace, name string) (*unstructured.Unstructured, *meta.RESTMapping, error) {
+	resource, mapping, err := f.resourceFor(kind, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	dependency := Dependency{Resource: mapping.Resource, Namespace: scopedNamespace(mapping, namespace), Name: name}
+	l := f.cached(r, dependency, func() lookup {
+		obj, err := resource.Get(context.Background(), name, metav1.GetOptions{})
+		l := lookup{dependency: dependency, object: obj, err: err}
+		if err == nil {
+			l.dependency.ResourceVersion = obj.GetResourceVersion()
+		}
+		return l
+	})
+	return l.object, mapping, l.err
+}
+
+// listObjects returns a list of objects, listing them at most once per render
+func (f *Functions) listObjects(r *renderLookups, kind, namespace string, options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	resource, mapping, err := f.resourceFor(kind, namespace)
+	if err != nil {
+		return nil, err
+	}
+	dependency := Dependency{
+		Resource:      mapping.Resource,
+		Namespace:     scopedNamespace(mapping, namespace),
+		LabelSelector: options.LabelSelector,
+		FieldSelector: options.FieldSelector,
+	}
+	l := f.cached(r, dependency, func() lookup {
+		list, err := resource.List(context.Background(), options)
+		l := lookup{dependency: dependency, list: list, err: err}
+		if err == nil {
+			l.dependency.ResourceVersion = list.GetResourceVersion()
+		}
+		return l
+	})
+	return l.list, l.err
+}
+
+// cached returns the lookup for dependency from the render or shared cache, calling read on a miss.
+// Objects that are not found are cached for the render, but only successful reads are shared.
+// r is the render's lookups, or nil for the current render
+func (f *Functions) cached(r *renderLookups, dependency Dependency, read func() lookup) lookup {
+	if r == nil {
+		r = f.currentLookups()
+	}
+	key := dependency.key()
+	r.lock.Lock()
+	l, ok := r.lookups[key]
+	r.lock.Unlock()
+	if ok {
+		return l
+	}
+
+	if f.SharedCache != nil {
+		l, ok = f.SharedCache.get(key)
+	}
+	if !ok {
+		l = read()
+		if f.SharedCache != nil && l.err == nil {
+			f.SharedCache.set(key, l)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.lookups == nil {
+		r.lookups = make(map[string]lookup)
+	}
+	if _, ok := r.lookups[key]; !ok {
+		r.lookups[key] = l
+		if l.err == nil || apierrors.IsNotFound(l.err) {
+			r.dependencies = append(r.dependencies, l.dependency)
+		}
+	}
+	return l
+}
+
+func scopedNamespace(mapping *meta.RESTMapping, namespace string) string {
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return ""
+	}
+	return namespace
+}
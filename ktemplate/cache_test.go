@@ -0,0 +1,136 @@
+package ktemplate
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+)
+
+type lookupTest struct {
+	User     string `template:"true"`
+	Password string `template:"true"`
+	Hosts    string `template:"true"`
+	Missing  string `template:"true"`
+}
+
+func countActions(client *fake.FakeDynamicClient, verb string) int {
+	n := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == verb {
+			n++
+		}
+	}
+	return n
+}
+
+func newDatabaseSecret() runtime.Object {
+	return newObject("v1", "Secret", "default", "db", map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "7"},
+		"data":     map[string]interface{}{"user": "YWRtaW4=", "password": "c2VjcmV0"},
+	})
+}
+
+func newLookupTest() *lookupTest {
+	return &lookupTest{
+		User:     `{{ kget "secret/default/db" "user" }}`,
+		Password: `{{ kget "secret/default/db" "password" }}`,
+		Hosts:    `{{ len (klist "configmap/default" "app=db") }}`,
+		Missing:  `{{ kget "secret/default/other" "password" }}`,
+	}
+}
+
+func TestWalkWithDependencies(t *testing.T) {
+	client, mapper := newTestClient(newDatabaseSecret())
+	templater := StructTemplater{DynamicClient: client, RESTMapper: mapper, RequiredTag: "template"}
+
+	input := newLookupTest()
+	dependencies, err := templater.WalkWithDependencies(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "admin", input.User)
+	assert.Equal(t, "secret", input.Password)
+	assert.Equal(t, "0", input.Hosts)
+	assert.Equal(t, 2, countActions(client, "get"), "each object should be read once per render")
+	assert.Equal(t, 1, countActions(client, "list"))
+
+	secrets := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	assert.Equal(t, []Dependency{
+		{Resource: secrets, Namespace: "default", Name: "db", ResourceVersion: "7"},
+		{Resource: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, Namespace: "default", LabelSelector: "app=db"},
+		{Resource: secrets, Namespace: "default", Name: "other"},
+	}, dependencies)
+
+	// each walk is a new render
+	if err := templater.Walk(newLookupTest()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, countActions(client, "get"))
+}
+
+func TestSharedLookupCache(t *testing.T) {
+	client, mapper := newTestClient(newDatabaseSecret())
+	f := NewFunctionsWithDynamicClient(nil, client, mapper)
+	f.SharedCache = NewLookupCache(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		out, err := f.Template(`{{ kget "secret/default/db" "user" }},{{ kget "secret/default/other" "user" }}`, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "admin,", out)
+		assert.Equal(t, 2, len(f.Dependencies()), "dependencies should be reset for each render")
+	}
+	// objects that were not found are read again by the next render
+	assert.Equal(t, 3, countActions(client, "get"))
+
+	f.SharedCache = NewLookupCache(-time.Second)
+	_, err := f.Template(`{{ kget "secret/default/db" "user" }}`, nil)
+	assert.NoError(t, err)
+	_, err = f.Template(`{{ kget "secret/default/db" "user" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, countActions(client, "get"), "expired entries should be read again")
+}
+
+func TestTemplateConcurrent(t *testing.T) {
+	var gets int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/namespaces/default/secrets/slow" {
+			// keep the render in progress while other renders start
+			time.Sleep(20 * time.Millisecond)
+		} else {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"kind":"Secret","apiVersion":"v1","metadata":{"name":"db","namespace":"default"},"data":{"user":"YWRtaW4="}}`) // nolint: errcheck
+	}))
+	defer apiServer.Close()
+	_, mapper := newTestClient()
+	// the dynamic client is created by the first lookup
+	f := &Functions{RESTConfig: &rest.Config{Host: apiServer.URL, QPS: 1000, Burst: 1000}, restMapper: mapper}
+
+	const renders = 20
+	var wg sync.WaitGroup
+	for i := 0; i < renders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+			out, err := f.Template(`{{ kget "secret/default/db" "user" }}-{{ kget "secret/default/slow" "user" }}-{{ kget "secret/default/db" "user" }}-{{ .i }}`, map[string]interface{}{"i": i})
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("admin-admin-admin-%d", i), out)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(renders), atomic.LoadInt32(&gets), "each render should read the secret once")
+	assert.Equal(t, 2, len(f.Dependencies()))
+}
@@ -0,0 +1,121 @@
+package ktemplate
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// clientsetKinds are the kinds that can be looked up with only a clientset, as kget did before
+// it used the dynamic client
+var clientsetKinds = map[string]schema.GroupVersionKind{
+	"configmap":  {Version: "v1", Kind: "ConfigMap"},
+	"configmaps": {Version: "v1", Kind: "ConfigMap"},
+	"cm":         {Version: "v1", Kind: "ConfigMap"},
+	"secret":     {Version: "v1", Kind: "Secret"},
+	"secrets":    {Version: "v1", Kind: "Secret"},
+	"service":    {Version: "v1", Kind: "Service"},
+	"services":   {Version: "v1", Kind: "Service"},
+	"svc":        {Version: "v1", Kind: "Service"},
+}
+
+// clientsetMapping returns the mapping of a kind that can be looked up with only a clientset
+func clientsetMapping(kind string) (*meta.RESTMapping, error) {
+	gvk, ok := clientsetKinds[kind]
+	if !ok {
+		return nil, errors.Errorf("kind %s can only be looked up with a rest config or dynamic client", kind)
+	}
+	plural, _ := meta.UnsafeGuessKindToResource(gvk)
+	return &meta.RESTMapping{Resource: plural, GroupVersionKind: gvk, Scope: meta.RESTScopeNamespace}, nil
+}
+
+// clientsetResource reads configmaps, secrets and services with a typed clientset, for Functions
+// created without a rest config or dynamic client. Only Get and List are implemented
+type clientsetResource struct {
+	dynamic.ResourceInterface
+	clientset *kubernetes.Clientset
+	mapping   *meta.RESTMapping
+	namespace string
+}
+
+func (r clientsetResource) Get(ctx context.Context, name string, options metav1.GetOptions, _ ...string) (*unstructured.Unstructured, error) {
+	var obj runtime.Object
+	var err error
+	core := r.clientset.CoreV1()
+	switch r.mapping.GroupVersionKind.Kind {
+	case "ConfigMap":
+		obj, err = core.ConfigMaps(r.namespace).Get(ctx, name, options)
+	case "Secret":
+		obj, err = core.Secrets(r.namespace).Get(ctx, name, options)
+	default:
+		obj, err = core.Services(r.namespace).Get(ctx, name, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.toUnstructured(obj)
+}
+
+func (r clientsetResource) List(ctx context.Context, options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	var items []runtime.Object
+	var resourceVersion string
+	core := r.clientset.CoreV1()
+	switch r.mapping.GroupVersionKind.Kind {
+	case "ConfigMap":
+		list, err := core.ConfigMaps(r.namespace).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+		resourceVersion = list.ResourceVersion
+	case "Secret":
+		list, err := core.Secrets(r.namespace).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+		resourceVersion = list.ResourceVersion
+	default:
+		list, err := core.Services(r.namespace).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+		resourceVersion = list.ResourceVersion
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetResourceVersion(resourceVersion)
+	for _, item := range items {
+		obj, err := r.toUnstructured(item)
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, *obj)
+	}
+	return list, nil
+}
+
+// toUnstructured converts a typed object, which the clientset returns without its apiVersion and kind
+func (r clientsetResource) toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(r.mapping.GroupVersionKind)
+	return u, nil
+}
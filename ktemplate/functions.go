@@ -1,28 +1,86 @@
 package ktemplate
 
 import (
+	"sync"
 	"text/template"
 
 	"github.com/flanksource/commons/text"
 	"github.com/flanksource/gomplate/v3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type Functions struct {
 	clientset             *kubernetes.Clientset
+	dynamicClient         dynamic.Interface
+	restMapper            meta.RESTMapper
 	RightDelim, LeftDelim string
 	Custom                template.FuncMap
+	// Strict makes failed kget and klist lookups return an error that aborts the template,
+	// rather than logging it and returning an empty value
+	Strict bool
+	// SharedCache caches lookups across renders, lookups are otherwise only cached until the next Reset
+	SharedCache *LookupCache
+	// Sandbox restricts the functions and lookups available to templates and limits their output and run time
+	Sandbox *Sandbox
+	// RESTConfig is used to create the dynamic client for lookups when one is not provided
+	RESTConfig *rest.Config
+
+	// lock guards the lazily created clients and the current render
+	lock    sync.Mutex
+	current *renderLookups
 }
 
+// NewFunctions creates Functions that look up objects with clientset, only configmaps, secrets and
+// services can be looked up unless RESTConfig is set
 func NewFunctions(clientset *kubernetes.Clientset) *Functions {
 	return &Functions{clientset: clientset}
 }
 
+// NewFunctionsWithDynamicClient creates Functions that look up objects with dynamicClient and restMapper,
+// either can be nil in which case they are created from RESTConfig and clientset respectively
+func NewFunctionsWithDynamicClient(clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, restMapper meta.RESTMapper) *Functions {
+	return &Functions{clientset: clientset, dynamicClient: dynamicClient, restMapper: restMapper}
+}
+
 func (f *Functions) FuncMap() template.FuncMap {
+	return f.funcMap(false, nil)
+}
+
+// funcMap returns the template functions, with lookups cached in r or the current render if r is nil.
+// dryRun replaces lookups with empty values so that templates can be validated without a cluster
+func (f *Functions) funcMap(dryRun bool, r *renderLookups) template.FuncMap {
 	fm := gomplate.CreateFuncs(nil)
-	fm["kget"] = f.KGet
+	kget := func(path, jsonpath string, options ...string) (string, error) {
+		return f.kget(r, path, jsonpath, options...)
+	}
+	klist := func(path string, selectors ...string) ([]interface{}, error) {
+		return f.klist(r, path, selectors...)
+	}
+	if f.Strict {
+		fm["kget"] = kget
+		fm["klist"] = klist
+	} else {
+		fm["kget"] = func(path, jsonpath string, options ...string) string {
+			return logKGet(kget(path, jsonpath, options...))
+		}
+		fm["klist"] = func(path string, selectors ...string) []interface{} {
+			return logKList(klist(path, selectors...))
+		}
+	}
+	fm["kgetDefault"] = func(path, jsonpath, defaultValue string, options ...string) string {
+		return f.kgetDefault(r, path, jsonpath, defaultValue, options...)
+	}
+	if dryRun {
+		fm["kget"] = func(path, jsonpath string, options ...string) string { return "" }
+		fm["klist"] = func(path string, selectors ...string) []interface{} { return nil }
+		fm["kgetDefault"] = func(path, jsonpath, defaultValue string, options ...string) string { return defaultValue }
+	}
 	fm["jsonPath"] = f.JSONPath
 	fm["parseMarkdownTables"] = f.ParseMarkdownTables
+	fm["parseMarkdown"] = f.ParseMarkdown
 	for k, v := range f.Custom {
 		fm[k] = v
 	}
@@ -32,5 +90,8 @@ func (f *Functions) FuncMap() template.FuncMap {
 			fm[funcName] = commonFuncs[funcName]
 		}
 	}
+	if f.Sandbox != nil {
+		return f.Sandbox.filter(fm, f.Custom)
+	}
 	return fm
 }
@@ -1,69 +1,265 @@
 package ktemplate
 
 import (
-	"context"
-	"encoding/json"
+	"encoding/base64"
+	"fmt"
 	"strings"
 
 	"github.com/flanksource/commons/logger"
+	"github.com/pkg/errors"
 	"github.com/tidwall/gjson"
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
 )
 
-func (f *Functions) KGet(path, jsonpath string) string {
+// errValueNotFound is returned by kget when the object exists but has no value at the jsonpath
+var errValueNotFound = errors.New("no value found")
+
+// KGet returns the value at the gjson path in an object, where path is kind/namespace/name,
+// or kind//name for cluster-scoped objects. kind can be any kind, resource or short name known to
+// the API server, qualified with a group if ambiguous e.g. certificates.cert-manager.io.
+// Passing "base64" as an option decodes the value, secret data keys are also accepted as the
+// jsonpath, take precedence over fields with the same name and are always decoded.
+// Failed lookups are logged and return an empty string, unless Strict is set in which case they abort the template.
+func (f *Functions) KGet(path, jsonpath string, options ...string) string {
+	return logKGet(f.kget(nil, path, jsonpath, options...))
+}
+
+// logKGet logs a failed kget, objects that were not found are not logged
+func logKGet(value string, err error) string {
+	if err != nil && !isNotFound(err) {
+		logger.Errorf("%v", err)
+	}
+	return value
+}
+
+// KGetDefault is KGet that returns defaultValue rather than failing, including when Strict is set
+func (f *Functions) KGetDefault(path, jsonpath, defaultValue string, options ...string) string {
+	return f.kgetDefault(nil, path, jsonpath, defaultValue, options...)
+}
+
+func (f *Functions) kgetDefault(r *renderLookups, path, jsonpath, defaultValue string, options ...string) string {
+	value, err := f.kget(r, path, jsonpath, options...)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// kget looks up the object in r, or the current render's lookups if r is nil
+func (f *Functions) kget(r *renderLookups, path, jsonpath string, options ...string) (string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) != 3 {
-		logger.Errorf("invalid call to kget: expected path to contain kind/namespace/name")
-		return ""
+		return "", errors.Errorf("invalid call to kget %s: expected path to contain kind/namespace/name", path)
 	}
 
 	kind := parts[0]
 	namespace := parts[1]
 	name := parts[2]
 
-	if kind == "configmap" || kind == "cm" {
-		cm, err := f.clientset.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
-		if err != nil {
-			if !errors.IsNotFound(err) {
-				logger.Errorf("failed to read configmap name %s namespace %s: %v", name, namespace, err)
-			}
-			return ""
-		}
+	obj, mapping, err := f.getObject(r, kind, namespace, name)
+	if mapping == nil && meta.IsNoMatchError(errors.Cause(err)) {
+		return "", errors.Wrapf(err, "invalid call to kget %s", path)
+	}
+	if mapping == nil {
+		return "", errors.Wrapf(err, "kget %s failed", path)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "kget %s failed to read %s name %s namespace %s", path, kind, name, namespace)
+	}
 
-		encodedJSON, err := json.Marshal(cm)
-		if err != nil {
-			logger.Errorf("failed to encode json name %s namespace %s: %v", name, namespace, err)
-			return ""
+	encodedJSON, err := obj.MarshalJSON()
+	if err != nil {
+		return "", errors.Wrapf(err, "kget %s failed to encode json", path)
+	}
+	decode := false
+	for _, option := range options {
+		if option == "base64" {
+			decode = true
 		}
-		value := gjson.Get(string(encodedJSON), jsonpath)
-		return value.String()
-	} else if kind == "secret" {
-		secret, err := f.clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
-		if err != nil {
-			if !errors.IsNotFound(err) {
-				logger.Errorf("failed to read secret name %s namespace %s: %v", name, namespace, err)
-			}
-			return ""
+	}
+	var value gjson.Result
+	// secrets were previously looked up by their data key rather than a path, so a data key
+	// takes precedence over a top-level field with the same name e.g. type
+	isSecret := mapping.GroupVersionKind.GroupKind() == (schema.GroupKind{Kind: "Secret"})
+	if isSecret && !strings.Contains(jsonpath, ".") {
+		if value = gjson.GetBytes(encodedJSON, "data."+escapeGJSON(jsonpath)); value.Exists() {
+			decode = true
 		}
-		return string(secret.Data[jsonpath])
-	} else if kind == "service" || kind == "svc" {
-		svc, err := f.clientset.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
-		if err != nil {
-			if !errors.IsNotFound(err) {
-				logger.Errorf("failed to read service name %s namespace %s: %v", name, namespace, err)
-			}
-			return ""
+	}
+	if !value.Exists() {
+		value = gjson.GetBytes(encodedJSON, jsonpath)
+	}
+	if !value.Exists() && isSecret {
+		value = gjson.GetBytes(encodedJSON, "data."+escapeGJSON(jsonpath))
+		decode = true
+	}
+	if !value.Exists() {
+		return "", errors.Wrapf(errValueNotFound, "kget %s %s", path, jsonpath)
+	}
+	if !decode {
+		return value.String(), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "kget %s failed to decode %s", path, jsonpath)
+	}
+	return string(decoded), nil
+}
+
+func isNotFound(err error) bool {
+	return apierrors.IsNotFound(err) || errors.Is(err, errValueNotFound)
+}
+
+// KList returns the objects of a kind as maps that can be used with range, jsonPath and other functions.
+// path is kind/namespace, or kind for cluster-scoped objects and all namespaces. The first selector
+// is a label selector and the second a field selector, e.g. klist "ingress/default" "app=web".
+// Failed lookups are logged and return no objects, unless Strict is set
+func (f *Functions) KList(path string, selectors ...string) []interface{} {
+	return logKList(f.klist(nil, path, selectors...))
+}
+
+func logKList(items []interface{}, err error) []interface{} {
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+	return items
+}
+
+// klist lists the objects in r, or the current render's lookups if r is nil
+func (f *Functions) klist(r *renderLookups, path string, selectors ...string) ([]interface{}, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || len(selectors) > 2 {
+		return nil, errors.Errorf("invalid call to klist %s: expected kind/namespace and at most a label and field selector", path)
+	}
+	kind := parts[0]
+	namespace := ""
+	if len(parts) == 2 {
+		namespace = parts[1]
+	}
+	options := metav1.ListOptions{}
+	if len(selectors) > 0 {
+		options.LabelSelector = selectors[0]
+	}
+	if len(selectors) > 1 {
+		options.FieldSelector = selectors[1]
+	}
+
+	list, err := f.listObjects(r, kind, namespace, options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "klist %s failed to list %s namespace %s", path, kind, namespace)
+	}
+	items := make([]interface{}, 0, len(list.Items))
+	for _, item := range list.Items {
+		// the list is cached for the render, so templates get a copy they are free to modify
+		items = append(items, item.DeepCopy().Object)
+	}
+	return items, nil
+}
+
+// escapeGJSON escapes the characters that have a special meaning in a gjson path
+func escapeGJSON(key string) string {
+	return strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`, "|", `\|`, "#", `\#`, "@", `\@`).Replace(key)
+}
+
+// resourceFor returns a client for kind in namespace, namespace is ignored for cluster-scoped
+// kinds and an empty namespace selects all namespaces
+func (f *Functions) resourceFor(kind, namespace string) (dynamic.ResourceInterface, *meta.RESTMapping, error) {
+	mapping, err := f.mappingFor(kind)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to find resource for kind %s", kind)
+	}
+	if f.Sandbox != nil {
+		if err := f.allowLookup(mapping, scopedNamespace(mapping, namespace)); err != nil {
+			return nil, nil, err
+		}
+	}
+	f.lock.Lock()
+	clientsetOnly := f.clientsetOnly()
+	f.lock.Unlock()
+	if clientsetOnly {
+		if _, err := clientsetMapping(strings.ToLower(mapping.GroupVersionKind.Kind)); err != nil || mapping.GroupVersionKind.Group != "" {
+			return nil, nil, errors.Errorf("%s can only be looked up with a rest config or dynamic client", mapping.Resource.GroupResource())
 		}
+		return clientsetResource{clientset: f.clientset, mapping: mapping, namespace: namespace}, mapping, nil
+	}
+	client, err := f.getDynamicClient()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && namespace != "" {
+		return client.Resource(mapping.Resource).Namespace(namespace), mapping, nil
+	}
+	return client.Resource(mapping.Resource), mapping, nil
+}
 
-		encodedJSON, err := json.Marshal(svc)
+// mappingFor resolves a kind, resource or short name, optionally qualified with a version and group
+func (f *Functions) mappingFor(kind string) (*meta.RESTMapping, error) {
+	kind = strings.ToLower(kind)
+	mapper, err := f.getRESTMapper()
+	if err != nil {
+		return nil, err
+	}
+	if mapper == nil {
+		return clientsetMapping(kind)
+	}
+	var gvk schema.GroupVersionKind
+	fullySpecified, groupResource := schema.ParseResourceArg(kind)
+	if fullySpecified != nil {
+		gvk, _ = mapper.KindFor(*fullySpecified)
+	}
+	if gvk.Empty() {
+		gvk, err = mapper.KindFor(groupResource.WithVersion(""))
 		if err != nil {
-			logger.Errorf("failed to encode json name %s namespace %s: %v", name, namespace, err)
-			return ""
+			return nil, err
 		}
-		value := gjson.Get(string(encodedJSON), jsonpath)
-		return value.String()
 	}
+	return mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+}
 
-	return ""
+// getRESTMapper returns the REST mapper, or nil if kinds are mapped by clientsetMapping
+func (f *Functions) getRESTMapper() (meta.RESTMapper, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.restMapper != nil {
+		return f.restMapper, nil
+	}
+	if f.clientsetOnly() {
+		return nil, nil
+	}
+	if f.clientset == nil {
+		return nil, fmt.Errorf("no clientset configured")
+	}
+	discovery := memory.NewMemCacheClient(f.clientset.Discovery())
+	f.restMapper = restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(discovery), discovery, nil)
+	return f.restMapper, nil
+}
+
+// clientsetOnly is true when Functions were created with only a clientset, in which case configmaps,
+// secrets and services are looked up with the clientset as no dynamic client can be created.
+// f.lock must be held
+func (f *Functions) clientsetOnly() bool {
+	return f.dynamicClient == nil && f.RESTConfig == nil && f.clientset != nil
+}
+
+func (f *Functions) getDynamicClient() (dynamic.Interface, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.dynamicClient != nil {
+		return f.dynamicClient, nil
+	}
+	if f.RESTConfig == nil {
+		return nil, fmt.Errorf("no rest config configured")
+	}
+	client, err := dynamic.NewForConfig(f.RESTConfig)
+	if err != nil {
+		return nil, err
+	}
+	f.dynamicClient = client
+	return f.dynamicClient, nil
 }
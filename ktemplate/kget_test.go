@@ -0,0 +1,180 @@
+package ktemplate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func newTestFunctions(objects ...runtime.Object) *Functions {
+	client, mapper := newTestClient(objects...)
+	return NewFunctionsWithDynamicClient(nil, client, mapper)
+}
+
+func newTestClient(objects ...runtime.Object) (*fake.FakeDynamicClient, meta.RESTMapper) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}, meta.RESTScopeNamespace)
+
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}:                    "ConfigMapList",
+		{Version: "v1", Resource: "secrets"}:                       "SecretList",
+		{Version: "v1", Resource: "namespaces"}:                    "NamespaceList",
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	}, objects...)
+	return client, mapper
+}
+
+func newObject(apiVersion, kind, namespace, name string, fields map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: fields}
+	if obj.Object == nil {
+		obj.Object = map[string]interface{}{}
+	}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestKGet(t *testing.T) {
+	f := newTestFunctions(
+		newObject("v1", "ConfigMap", "default", "settings", map[string]interface{}{
+			"data": map[string]interface{}{"key": "value", "app.properties": "a=b"},
+		}),
+		newObject("v1", "Secret", "default", "credentials", map[string]interface{}{
+			"type": "Opaque",
+			"data": map[string]interface{}{"password": "c2VjcmV0", "tls.crt": "Y2VydA==", "type": "YmFzaWM="},
+		}),
+		newObject("v1", "Namespace", "", "monitoring", map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": map[string]interface{}{"team": "sre"}},
+		}),
+		newObject("example.com/v1", "Widget", "default", "gear", map[string]interface{}{
+			"spec": map[string]interface{}{"size": int64(3)},
+		}),
+	)
+
+	tests := []struct {
+		path, jsonpath string
+		options        []string
+		want           string
+	}{
+		{"configmap/default/settings", "data.key", nil, "value"},
+		{"ConfigMap/default/settings", `data.app\.properties`, nil, "a=b"},
+		{"configmaps/default/missing", "data.key", nil, ""},
+		{"secret/default/credentials", "password", nil, "secret"},
+		{"secret/default/credentials", "tls.crt", nil, "cert"},
+		{"secret/default/credentials", "type", nil, "basic"},
+		{"secret/default/credentials", "metadata.name", nil, "credentials"},
+		{"secret/default/credentials", "data.password", nil, "c2VjcmV0"},
+		{"secret/default/credentials", "data.password", []string{"base64"}, "secret"},
+		{"namespace//monitoring", "metadata.labels.team", nil, "sre"},
+		{"widget/default/gear", "spec.size", nil, "3"},
+		{"widgets.example.com/default/gear", "spec.size", nil, "3"},
+		{"unknown/default/gear", "spec.size", nil, ""},
+	}
+	for _, test := range tests {
+		if got := f.KGet(test.path, test.jsonpath, test.options...); got != test.want {
+			t.Errorf("kget %s %s: expected %q, got %q", test.path, test.jsonpath, test.want, got)
+		}
+	}
+}
+
+func TestKList(t *testing.T) {
+	labels := func(app string) map[string]interface{} {
+		return map[string]interface{}{"labels": map[string]interface{}{"app": app}}
+	}
+	f := newTestFunctions(
+		newObject("v1", "ConfigMap", "default", "web", map[string]interface{}{"metadata": labels("web"), "data": map[string]interface{}{"host": "web.example.com"}}),
+		newObject("v1", "ConfigMap", "default", "api", map[string]interface{}{"metadata": labels("api"), "data": map[string]interface{}{"host": "api.example.com"}}),
+		newObject("v1", "ConfigMap", "other", "web", map[string]interface{}{"metadata": labels("web"), "data": map[string]interface{}{"host": "other.example.com"}}),
+		newObject("v1", "Namespace", "", "monitoring", nil),
+	)
+
+	assert.Equal(t, 3, len(f.KList("configmap")))
+	assert.Equal(t, 2, len(f.KList("configmap/default")))
+	assert.Equal(t, 2, len(f.KList("configmap", "app=web")))
+	assert.Equal(t, 1, len(f.KList("namespace")))
+	assert.Equal(t, 0, len(f.KList("unknown/default")))
+
+	out, err := f.Template(`{{ range klist "configmap/default" "app in (api)" }}{{ .data.host }},{{ end }}{{ jsonPath (klist "configmap/other" "app=web") "#.data.host" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `api.example.com,["other.example.com"]`, out)
+}
+
+func TestKGetStrict(t *testing.T) {
+	f := newTestFunctions(newObject("v1", "Secret", "default", "credentials", map[string]interface{}{
+		"data": map[string]interface{}{"password": "c2VjcmV0"},
+	}))
+
+	out, err := f.Template(`password={{ kget "secret/default/missing" "password" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "password=", out)
+
+	f.Strict = true
+	for _, tpl := range []string{
+		`password={{ kget "secret/default/missing" "password" }}`,
+		`password={{ kget "secret/default/credentials" "username" }}`,
+		`password={{ kget "secret/credentials" "password" }}`,
+		`{{ range klist "unknown/default" }}{{ end }}`,
+	} {
+		_, err := f.Template(tpl, nil)
+		if err == nil {
+			t.Errorf("expected %s to fail", tpl)
+			continue
+		}
+		assert.Contains(t, err.Error(), tpl[:8], "the error should name the template")
+		assert.Contains(t, err.Error(), "error calling k", "the error should name the lookup")
+	}
+
+	out, err = f.Template(`{{ kget "secret/default/credentials" "password" }},{{ kgetDefault "secret/default/missing" "password" "changeme" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret,changeme", out)
+}
+
+func TestKGetClientset(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/configmaps/settings":
+			io.WriteString(w, `{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"settings","namespace":"default"},"data":{"key":"value"}}`) // nolint: errcheck
+		case "/api/v1/namespaces/default/secrets/credentials":
+			io.WriteString(w, `{"kind":"Secret","apiVersion":"v1","metadata":{"name":"credentials","namespace":"default"},"data":{"password":"c2VjcmV0"}}`) // nolint: errcheck
+		case "/api/v1/namespaces/default/services":
+			io.WriteString(w, `{"kind":"ServiceList","apiVersion":"v1","metadata":{},"items":[{"metadata":{"name":"web"},"spec":{"clusterIP":"10.0.0.1"}}]}`) // nolint: errcheck
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`) // nolint: errcheck
+		}
+	}))
+	defer apiServer.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFunctions(clientset)
+	f.Strict = true
+	out, err := f.Template(`{{ kget "configmap/default/settings" "data.key" }} {{ kget "secret/default/credentials" "password" }} {{ range klist "svc/default" }}{{ .metadata.name }}={{ .spec.clusterIP }}{{ end }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "value secret web=10.0.0.1", out)
+
+	_, err = f.Template(`{{ kget "widget/default/gear" "spec.size" }}`, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "can only be looked up with a rest config")
+		assert.NotContains(t, err.Error(), "invalid call")
+	}
+}
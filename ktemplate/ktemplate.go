@@ -9,31 +9,69 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-// Template templates out a template using gomplate
+// Template templates out a template using gomplate, each call is a separate render
+// with its own lookup cache and Dependencies, so concurrent calls do not share lookups
 func (f *Functions) Template(template string, vars interface{}) (string, error) {
+	r := &renderLookups{}
+	out, err := f.renderWith(r, template, vars)
+	f.lock.Lock()
+	f.current = r
+	f.lock.Unlock()
+	return out, err
+}
+
+// render templates out a template, reusing the objects looked up since the last Reset
+func (f *Functions) render(template string, vars interface{}) (string, error) {
+	return f.renderWith(f.currentLookups(), template, vars)
+}
+
+// renderWith templates out a template, caching lookups in r
+func (f *Functions) renderWith(r *renderLookups, template string, vars interface{}) (string, error) {
 	if strings.TrimSpace(template) == "" {
 		return "", nil
 	}
-	tpl := gotemplate.New("")
-	if f.LeftDelim != "" {
-		tpl = tpl.Delims(f.LeftDelim, f.RightDelim)
+	fm := f.funcMap(false, r)
+	tpl, err := f.parse(template, fm)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %s: %v", strings.Split(template, "\n")[0], err)
 	}
 
-	tpl, err := tpl.Funcs(f.FuncMap()).Parse(template)
+	unstructured, err := toUnstructured(vars)
+	if err != nil {
+		return "", err
+	}
 
+	out, err := f.execute(tpl, fm, unstructured)
 	if err != nil {
-		return "", fmt.Errorf("invalid template %s: %v", strings.Split(template, "\n")[0], err)
+		return "", fmt.Errorf("error executing template %s: %w", strings.Split(template, "\n")[0], err)
+	}
+	return out, nil
+}
+
+// execute runs tpl, within the limits of the Sandbox if any, fm are the functions tpl was parsed with
+func (f *Functions) execute(tpl *gotemplate.Template, fm gotemplate.FuncMap, data interface{}) (string, error) {
+	if f.Sandbox != nil {
+		return f.Sandbox.execute(tpl, fm, data)
+	}
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func (f *Functions) parse(template string, fm gotemplate.FuncMap) (*gotemplate.Template, error) {
+	tpl := gotemplate.New("")
+	if f.LeftDelim != "" {
+		tpl = tpl.Delims(f.LeftDelim, f.RightDelim)
 	}
+	return tpl.Funcs(fm).Parse(template)
+}
 
+// toUnstructured converts vars to a map via yaml, so that fields are accessed by their yaml names
+func toUnstructured(vars interface{}) (map[string]interface{}, error) {
 	data, _ := yaml.Marshal(vars)
 	unstructured := make(map[string]interface{})
 	if err := yaml.Unmarshal(data, &unstructured); err != nil {
-		return "", err
-	}
-
-	var buf bytes.Buffer
-	if err := tpl.Execute(&buf, unstructured); err != nil {
-		return "", fmt.Errorf("error executing template %s: %v", strings.Split(template, "\n")[0], err)
+		return nil, err
 	}
-	return buf.String(), nil
+	return unstructured, nil
 }
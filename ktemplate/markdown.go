@@ -1,13 +1,115 @@
 package ktemplate
 
 import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/parser"
+	"gopkg.in/yaml.v3"
 )
 
 type MarkdownTable struct {
-	Columns []string   `json:"columns"`
-	Rows    [][]string `json:"rows"`
+	Columns []string `json:"columns"`
+	// Alignments are left, right, center or empty for each column
+	Alignments []string `json:"alignments"`
+	// Rows are the text of each cell, or the destination for cells that start with a link
+	Rows [][]string `json:"rows"`
+	// FormattedRows are the cells with their inline formatting, links and code as markdown
+	FormattedRows [][]string `json:"formattedRows"`
+	// Records are the Rows keyed by column name
+	Records []map[string]string `json:"records"`
+}
+
+// Markdown is the structure of a markdown document
+type Markdown struct {
+	FrontMatter map[string]interface{} `json:"frontMatter"`
+	Headings    []MarkdownHeading      `json:"headings"`
+	CodeBlocks  []MarkdownCodeBlock    `json:"codeBlocks"`
+	// Lists are the top level lists, nested lists are the Items of their parent item
+	Lists  []MarkdownList  `json:"lists"`
+	Tables []MarkdownTable `json:"tables"`
+}
+
+type MarkdownHeading struct {
+	Level int    `json:"level"`
+	Text  string `json:"text"`
+	// Content is the markdown following the heading up to the next heading of the same or a higher level
+	Content string `json:"content"`
+}
+
+type MarkdownCodeBlock struct {
+	// Language is the first word of a fenced code block's info string, it is empty for indented code blocks
+	Language string `json:"language"`
+	Code     string `json:"code"`
+}
+
+type MarkdownList struct {
+	Ordered bool               `json:"ordered"`
+	Items   []MarkdownListItem `json:"items"`
+}
+
+type MarkdownListItem struct {
+	Text  string             `json:"text"`
+	Items []MarkdownListItem `json:"items,omitempty"`
+}
+
+// Section returns the content of the first heading with text, or an empty string if there is none
+func (m Markdown) Section(text string) string {
+	for _, heading := range m.Headings {
+		if heading.Text == text {
+			return heading.Content
+		}
+	}
+	return ""
+}
+
+// Code returns the code blocks in language
+func (m Markdown) Code(language string) []string {
+	var code []string
+	for _, block := range m.CodeBlocks {
+		if block.Language == language {
+			code = append(code, block.Code)
+		}
+	}
+	return code
+}
+
+// ParseMarkdown parses the YAML front matter, headings and their sections, code blocks,
+// lists and tables of a markdown document
+func (f *Functions) ParseMarkdown(input string) (Markdown, error) {
+	doc := Markdown{}
+	input = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(input)
+	frontMatter, body := splitFrontMatter(input)
+	if frontMatter != "" {
+		if err := yaml.Unmarshal([]byte(frontMatter), &doc.FrontMatter); err != nil {
+			return doc, fmt.Errorf("invalid markdown front matter: %v", err)
+		}
+	}
+	source := []byte(body)
+	root := parser.New().Parse(source)
+	doc.Headings = extractHeadings(source, root)
+	doc.Tables = extractTextFromNode(root)
+	ast.WalkFunc(root, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch node := node.(type) {
+		case *ast.CodeBlock:
+			block := MarkdownCodeBlock{Code: string(node.Literal)}
+			if info := strings.Fields(string(node.Info)); node.IsFenced && len(info) > 0 {
+				block.Language = info[0]
+			}
+			doc.CodeBlocks = append(doc.CodeBlocks, block)
+		case *ast.List:
+			doc.Lists = append(doc.Lists, extractList(node))
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	return doc, nil
 }
 
 func (f *Functions) ParseMarkdownTables(input string) []MarkdownTable {
@@ -19,17 +121,25 @@ func (f *Functions) ParseMarkdownTables(input string) []MarkdownTable {
 	return records
 }
 
+// extractMultipleRowCell returns the text of a cell without formatting, or the destination of a cell that is only a link
 func extractMultipleRowCell(node ast.Node) string {
+	var link *ast.Link
 	for _, c := range node.GetChildren() {
 		switch cc := c.(type) {
 		case *ast.Text:
-			content := string(cc.AsLeaf().Literal)
-			if content != "" {
-				return content
+			if strings.TrimSpace(string(cc.Literal)) == "" {
+				continue
 			}
 		case *ast.Link:
-			return string(cc.Destination)
+			if link == nil {
+				link = cc
+				continue
+			}
 		}
+		return plainText(node)
+	}
+	if link != nil {
+		return string(link.Destination)
 	}
 	return ""
 }
@@ -99,14 +209,268 @@ func extractTable(node ast.Node) MarkdownTable {
 		case *ast.TableHeader:
 			col := extractTableHeader(nn)
 			table.Columns = col
+			table.Alignments = extractTableAlignments(nn)
 		case *ast.TableBody:
 			table.Rows = extractTableBody(nn)
+			table.FormattedRows = extractFormattedRows(nn)
 		}
 	}
 
+	for _, row := range table.Rows {
+		record := make(map[string]string, len(table.Columns))
+		for i, column := range table.Columns {
+			if i < len(row) {
+				record[column] = row[i]
+			} else {
+				record[column] = ""
+			}
+		}
+		table.Records = append(table.Records, record)
+	}
 	return table
 }
 
+func extractTableAlignments(node ast.Node) []string {
+	alignments := []string{}
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if cell, ok := n.(*ast.TableCell); ok && entering {
+			alignments = append(alignments, cell.Align.String())
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	return alignments
+}
+
+func extractFormattedRows(node ast.Node) [][]string {
+	rows := [][]string{}
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if row, ok := n.(*ast.TableRow); ok && entering {
+			cells := []string{}
+			for _, cell := range row.GetChildren() {
+				cells = append(cells, inlineMarkdown(cell))
+			}
+			rows = append(rows, cells)
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	return rows
+}
+
+// inlineMarkdown renders the inline children of node back to markdown
+func inlineMarkdown(node ast.Node) string {
+	var b strings.Builder
+	for _, c := range node.GetChildren() {
+		switch c := c.(type) {
+		case *ast.Text:
+			b.Write(c.Literal)
+		case *ast.Code:
+			b.WriteString("`" + string(c.Literal) + "`")
+		case *ast.Strong:
+			b.WriteString("**" + inlineMarkdown(c) + "**")
+		case *ast.Emph:
+			b.WriteString("*" + inlineMarkdown(c) + "*")
+		case *ast.Del:
+			b.WriteString("~~" + inlineMarkdown(c) + "~~")
+		case *ast.Link:
+			b.WriteString("[" + inlineMarkdown(c) + "](" + string(c.Destination) + ")")
+		case *ast.Image:
+			b.WriteString("![" + inlineMarkdown(c) + "](" + string(c.Destination) + ")")
+		case *ast.Softbreak:
+			b.WriteString(" ")
+		case *ast.Hardbreak:
+			b.WriteString("\n")
+		default:
+			b.WriteString(inlineMarkdown(c))
+		}
+	}
+	return b.String()
+}
+
+// plainText returns the text of node without formatting, blocks are separated by spaces
+func plainText(node ast.Node) string {
+	var parts []string
+	var b strings.Builder
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := n.(type) {
+		case *ast.Paragraph, *ast.Heading:
+			if b.Len() > 0 {
+				parts = append(parts, b.String())
+				b.Reset()
+			}
+		case *ast.Text:
+			b.Write(n.Literal)
+		case *ast.Code:
+			b.Write(n.Literal)
+		case *ast.Softbreak, *ast.Hardbreak:
+			b.WriteString(" ")
+		}
+		return ast.GoToNext
+	})
+	if b.Len() > 0 {
+		parts = append(parts, b.String())
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+func extractList(node *ast.List) MarkdownList {
+	list := MarkdownList{Ordered: node.ListFlags&ast.ListTypeOrdered != 0}
+	for _, item := range node.GetChildren() {
+		listItem := MarkdownListItem{}
+		var text []string
+		for _, c := range item.GetChildren() {
+			if nested, ok := c.(*ast.List); ok {
+				listItem.Items = append(listItem.Items, extractList(nested).Items...)
+				continue
+			}
+			if t := plainText(c); t != "" {
+				text = append(text, t)
+			}
+		}
+		listItem.Text = strings.Join(text, " ")
+		list.Items = append(list.Items, listItem)
+	}
+	return list
+}
+
+// splitFrontMatter returns the YAML front matter between --- lines at the start of input and the rest of the document
+func splitFrontMatter(input string) (string, string) {
+	if !strings.HasPrefix(input, "---\n") {
+		return "", input
+	}
+	lines := strings.SplitAfter(input, "\n")
+	for i := 1; i < len(lines); i++ {
+		if line := strings.TrimRight(lines[i], " \t\n"); line == "---" || line == "..." {
+			return strings.Join(lines[1:i], ""), strings.Join(lines[i+1:], "")
+		}
+	}
+	return "", input
+}
+
+var (
+	atxHeading      = regexp.MustCompile(`^#{1,6}(?:[ \t]|$)`)
+	setextUnderline = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	// containerMarkers are the block quote and list markers at the start of a line
+	containerMarkers = regexp.MustCompile(`^(?:[ \t]*(?:>|[-*+]|\d{1,9}[.)])(?:[ \t]|$))*[ \t]*`)
+)
+
+// extractHeadings returns the headings of root, parsed from source, with the markdown of each section.
+// The parser does not record positions, so the line of a heading is found from its text, which is a
+// slice of source unless the heading is in a block quote or list
+func extractHeadings(source []byte, root ast.Node) []MarkdownHeading {
+	lines := strings.Split(string(source), "\n")
+	type heading struct {
+		MarkdownHeading
+		start, end int
+	}
+	var headings []heading
+	// cursor is the line after the last text or code found in source, headings are searched for from there
+	cursor := 0
+	ast.WalkFunc(root, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch node := node.(type) {
+		case *ast.Text:
+			if line, ok := lineOf(source, node.Literal); ok {
+				cursor = line + 1
+			}
+		case *ast.CodeBlock:
+			cursor = skipCode(lines, cursor, string(node.Literal))
+		case *ast.Heading:
+			text := headingLiteral(node)
+			start, ok := lineOf(source, text)
+			if !ok {
+				start = findHeadingLine(lines, cursor, string(text))
+			}
+			end := start + 1
+			if !atxHeading.MatchString(containerMarkers.ReplaceAllString(lines[start], "")) {
+				// the underline of a setext heading
+				end++
+			}
+			headings = append(headings, heading{MarkdownHeading: MarkdownHeading{Level: node.Level, Text: plainText(node)}, start: start, end: end})
+			cursor = end
+		}
+		return ast.GoToNext
+	})
+
+	result := make([]MarkdownHeading, 0, len(headings))
+	for i, h := range headings {
+		end := len(lines)
+		for _, next := range headings[i+1:] {
+			if next.Level <= h.Level {
+				end = next.start
+				break
+			}
+		}
+		if h.end < end {
+			h.Content = strings.Trim(strings.Join(lines[h.end:end], "\n"), "\n")
+		}
+		result = append(result, h.MarkdownHeading)
+	}
+	return result
+}
+
+// headingLiteral returns the first text of heading
+func headingLiteral(heading *ast.Heading) []byte {
+	var literal []byte
+	ast.WalkFunc(heading, func(node ast.Node, entering bool) ast.WalkStatus {
+		if text, ok := node.(*ast.Text); ok && len(text.Literal) > 0 {
+			literal = text.Literal
+			return ast.Terminate
+		}
+		return ast.GoToNext
+	})
+	return literal
+}
+
+// lineOf returns the line of text in source if text is a slice of source
+func lineOf(source, text []byte) (int, bool) {
+	offset := cap(source) - cap(text)
+	if len(text) == 0 || offset < 0 || offset >= len(source) || &source[offset] != &text[0] {
+		return 0, false
+	}
+	return bytes.Count(source[:offset], []byte("\n")), true
+}
+
+// skipCode returns the line after code, which is copied from the source by the parser so that lines
+// in code blocks are not mistaken for headings
+func skipCode(lines []string, start int, code string) int {
+	code = strings.TrimSuffix(code, "\n")
+	if code == "" {
+		return start
+	}
+	first := strings.SplitN(code, "\n", 2)[0]
+	for i := start; i < len(lines); i++ {
+		if strings.Contains(lines[i], first) {
+			return i + strings.Count(code, "\n") + 1
+		}
+	}
+	return start
+}
+
+// findHeadingLine returns the first line from start that is a heading containing text, for headings in
+// block quotes and lists which are parsed from a copy of their lines without the markers
+func findHeadingLine(lines []string, start int, text string) int {
+	for i := start; i < len(lines); i++ {
+		line := containerMarkers.ReplaceAllString(lines[i], "")
+		if !strings.Contains(line, text) {
+			continue
+		}
+		if atxHeading.MatchString(line) {
+			return i
+		}
+		if i+1 < len(lines) && setextUnderline.MatchString(containerMarkers.ReplaceAllString(lines[i+1], "")) {
+			return i
+		}
+	}
+	return start
+}
+
 func extractTextFromNode(node ast.Node) []MarkdownTable {
 	switch node := node.(type) {
 	case *ast.Document:
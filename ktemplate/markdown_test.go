@@ -1,8 +1,12 @@
 package ktemplate
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseMarkdownTables(t *testing.T) {
@@ -86,3 +90,132 @@ API | Description | Auth | HTTPS | CORS |
 		}
 	})
 }
+
+const runbook = `---
+owner: sre
+services: [web, api]
+---
+# Web runbook
+
+Restart the **web** service.
+
+## Rollback
+
+1. Scale down
+2. Deploy the previous version
+   - check ` + "`kubectl rollout history`" + `
+   - pick a revision
+
+` + "```bash" + `
+kubectl rollout undo deployment/web
+# not a heading
+` + "```" + `
+
+## Inventory
+
+| Host | Role | CPU |
+|:-----|:----:|----:|
+| [web-1](https://web-1.example.com) | *primary* | 4 |
+| web-2 | standby |
+
+Contacts
+--------
+
+* Alice
+* Bob
+`
+
+func TestParseMarkdown(t *testing.T) {
+	f := NewFunctions(nil)
+	doc, err := f.ParseMarkdown(runbook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{"owner": "sre", "services": []interface{}{"web", "api"}}, doc.FrontMatter)
+
+	var headings []string
+	for _, heading := range doc.Headings {
+		headings = append(headings, fmt.Sprintf("%d %s", heading.Level, heading.Text))
+	}
+	assert.Equal(t, []string{"1 Web runbook", "2 Rollback", "2 Inventory", "2 Contacts"}, headings)
+	assert.True(t, strings.HasPrefix(doc.Headings[0].Content, "Restart the **web** service.\n\n## Rollback"))
+	assert.True(t, strings.HasSuffix(doc.Headings[0].Content, "* Bob"), "a section should include its subsections")
+	assert.Equal(t, "* Alice\n* Bob", doc.Section("Contacts"))
+	assert.Contains(t, doc.Section("Rollback"), "# not a heading")
+
+	assert.Equal(t, []MarkdownCodeBlock{{Language: "bash", Code: "kubectl rollout undo deployment/web\n# not a heading\n"}}, doc.CodeBlocks)
+	assert.Equal(t, []string{"kubectl rollout undo deployment/web\n# not a heading\n"}, doc.Code("bash"))
+
+	assert.Equal(t, []MarkdownList{
+		{Ordered: true, Items: []MarkdownListItem{
+			{Text: "Scale down"},
+			{Text: "Deploy the previous version", Items: []MarkdownListItem{{Text: "check kubectl rollout history"}, {Text: "pick a revision"}}},
+		}},
+		{Items: []MarkdownListItem{{Text: "Alice"}, {Text: "Bob"}}},
+	}, doc.Lists)
+
+	if assert.Equal(t, 1, len(doc.Tables)) {
+		table := doc.Tables[0]
+		assert.Equal(t, []string{"Host", "Role", "CPU"}, table.Columns)
+		assert.Equal(t, []string{"left", "center", "right"}, table.Alignments)
+		assert.Equal(t, []string{"[web-1](https://web-1.example.com)", "*primary*", "4"}, table.FormattedRows[0])
+		assert.Equal(t, []map[string]string{
+			{"Host": "https://web-1.example.com", "Role": "primary", "CPU": "4"},
+			{"Host": "web-2", "Role": "standby", "CPU": ""},
+		}, table.Records)
+	}
+
+	out, err := f.Template(`{{ $doc := parseMarkdown .runbook }}{{ $doc.FrontMatter.owner }} {{ range (index $doc.Tables 0).Records }}{{ .Role }},{{ end }}`, map[string]string{"runbook": runbook})
+	assert.NoError(t, err)
+	assert.Equal(t, "sre primary,standby,", out)
+
+	_, err = f.ParseMarkdown("---\nowner: [\n---\n# Title\n")
+	assert.Error(t, err)
+}
+
+func TestParseMarkdownHeadings(t *testing.T) {
+	f := NewFunctions(nil)
+	doc, err := f.ParseMarkdown("Intro\nStatus\n------\nAll good\n\n```\n> ## Escalation\n```\n\n> See Escalation\n> ## Escalation\n> Page the on-call\n\nThen wait\n\n#tag\n===\nend\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headings []string
+	for _, heading := range doc.Headings {
+		headings = append(headings, fmt.Sprintf("%d %s", heading.Level, heading.Text))
+	}
+	assert.Equal(t, []string{"2 Status", "2 Escalation", "1 #tag"}, headings, "headings should be the parser's")
+	assert.Equal(t, "All good\n\n```\n> ## Escalation\n```\n\n> See Escalation", doc.Section("Status"))
+	assert.Equal(t, "> Page the on-call\n\nThen wait", doc.Section("Escalation"))
+	assert.Equal(t, "end", doc.Section("#tag"))
+}
+
+func TestParseMarkdownInlineText(t *testing.T) {
+	f := NewFunctions(nil)
+	doc, err := f.ParseMarkdown(`## 1. Check logs
+
+## - dash
+
+## Use ` + "`kubectl`" + ` **now**
+
+| Step | Link |
+|------|------|
+| Restart **now** please | [docs](https://example.com/docs) |
+| [web](https://web.example.com) and *api* | see [docs](https://example.com/docs) |
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headings []string
+	for _, heading := range doc.Headings {
+		headings = append(headings, heading.Text)
+	}
+	assert.Equal(t, []string{"1. Check logs", "- dash", "Use kubectl now"}, headings)
+
+	if assert.Equal(t, 1, len(doc.Tables)) {
+		assert.Equal(t, [][]string{
+			{"Restart now please", "https://example.com/docs"},
+			{"web and api", "see docs"},
+		}, doc.Tables[0].Rows)
+	}
+}
@@ -0,0 +1,429 @@
+package ktemplate
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/flanksource/gomplate/v3/conv"
+	"github.com/flanksource/gomplate/v3/funcs"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// DefaultSandboxFunctions are functions without side effects, they do not read env vars, files,
+// the network or the clock. Namespaces such as coll and time are excluded as they expose
+// functions like coll.JQ that can read env vars
+var DefaultSandboxFunctions = []string{
+	// conversion and encoding
+	"base64", "conv", "data", "bool", "default", "join", "urlParse",
+	"json", "jsonArray", "yaml", "yamlArray", "toml", "csv", "csvByRow", "csvByColumn",
+	"toJSON", "toJSONPretty", "toYAML", "toTOML", "toCSV",
+	// strings
+	"strings", "regexp", "replaceAll", "title", "toUpper", "toLower", "trim", "indent", "quote", "shellQuote", "squote",
+	"contains", "hasPrefix", "hasSuffix", "startsWith", "endsWith", "split", "splitN",
+	"humanDuration", "humanSize", "semver", "semverCompare", "humanizeBytes", "humanizeDuration", "ftoa",
+	// math
+	"math", "add", "sub", "mul", "div", "rem", "pow", "seq",
+	// collections
+	"has", "slice", "dict", "keys", "values", "append", "prepend", "uniq", "reverse", "merge", "sort", "flatten",
+	// tests
+	"test", "assert", "fail", "required", "ternary", "kind", "isKind",
+	// kubernetes
+	"isHealthy", "getStatus", "getHealth", "jsonPath", "parseMarkdownTables", "parseMarkdown",
+}
+
+// lookupFunctions are only available in a sandbox with Lookups
+var lookupFunctions = []string{"kget", "kgetDefault", "klist"}
+
+// Sandbox restricts the functions and lookups available to untrusted templates, e.g. templates
+// from tenants' custom resources.
+// Range iterations and template calls are counted, so a render fails once it exceeds maxIterations of
+// them, and after a timeout it is stopped at the next iteration, function call or write. seq and the
+// functions that grow strings, such as strings.Repeat, indent and replaceAll, are capped
+type Sandbox struct {
+	// Functions that templates can call, DefaultSandboxFunctions is used if empty.
+	// Custom functions are always available as they are provided by the caller rather than the template
+	Functions []string
+	// Lookups are the objects that kget, kgetDefault and klist can read, they are not available if empty
+	Lookups []LookupRule
+	// MaxOutput is the maximum size of a rendered template in bytes, 0 for no limit
+	MaxOutput int
+	// Timeout is the maximum time a render can take, 0 for no limit
+	Timeout time.Duration
+}
+
+// LookupRule allows lookups of Kinds in Namespaces
+type LookupRule struct {
+	// Kinds are kinds, resources or short names as used in kget paths, all kinds are allowed if empty
+	Kinds []string
+	// Namespaces are the namespaces objects can be read from, all namespaces and cluster-scoped
+	// objects are allowed if empty, otherwise cluster-scoped objects are not allowed
+	Namespaces []string
+}
+
+// ErrOutputLimit is returned when a sandboxed template renders more than Sandbox.MaxOutput bytes
+var ErrOutputLimit = errors.New("template output exceeds the limit")
+
+// ErrTimeout is returned when a sandboxed template does not render within Sandbox.Timeout
+var ErrTimeout = errors.New("template timed out")
+
+const (
+	// maxSeq is the maximum number of elements seq can return in a sandbox
+	maxSeq = 10000
+	// maxString is the maximum length of a string returned by strings.Repeat, indent and other
+	// functions that grow strings in a sandbox
+	maxString = 1 << 20
+	// maxIterations is the maximum number of range iterations and template calls in a sandboxed render
+	maxIterations = 100000
+)
+
+// iterationFunction is called at the start of each range iteration and template call of a sandboxed render
+const iterationFunction = "sandboxIteration"
+
+func (s *Sandbox) filter(fm template.FuncMap, custom template.FuncMap) template.FuncMap {
+	allowed := s.Functions
+	if len(allowed) == 0 {
+		allowed = DefaultSandboxFunctions
+	}
+	if len(s.Lookups) > 0 {
+		allowed = append(append([]string{}, allowed...), lookupFunctions...)
+	}
+	math := sandboxMath{fm["math"].(func() interface{})().(*funcs.MathFuncs)}
+	strs := sandboxStrings{fm["strings"].(func() interface{})().(*funcs.StringFuncs)}
+	re := sandboxRegexp{fm["regexp"].(func() interface{})().(*funcs.ReFuncs)}
+	capped := template.FuncMap{
+		"math":       func() interface{} { return math },
+		"seq":        math.Seq,
+		"strings":    func() interface{} { return strs },
+		"indent":     strs.Indent,
+		"replaceAll": strs.ReplaceAll,
+		"regexp":     func() interface{} { return re },
+	}
+	sandboxed := make(template.FuncMap)
+	for _, name := range allowed {
+		if fn, ok := fm[name]; ok {
+			if c, ok := capped[name]; ok {
+				fn = c
+			}
+			sandboxed[name] = fn
+		}
+	}
+	for name, fn := range custom {
+		sandboxed[name] = fn
+	}
+	return sandboxed
+}
+
+// checkGrowth returns an error if a string of length n that grows by growth bytes count times
+// exceeds maxString
+func checkGrowth(fn string, n, count, growth int) error {
+	if count > 0 && growth > 0 && (growth > maxString/count || n+count*growth > maxString) {
+		return errors.Errorf("%s exceeds the sandbox limit of %d bytes", fn, maxString)
+	}
+	return nil
+}
+
+// sandboxMath is the math namespace with the size of seq capped
+type sandboxMath struct {
+	*funcs.MathFuncs
+}
+
+func (sandboxMath) Seq(n ...interface{}) ([]int64, error) {
+	start, end, step := int64(1), int64(0), int64(1)
+	switch len(n) {
+	case 0:
+		return nil, errors.New("seq must be given at least an end value")
+	case 1:
+		end = conv.ToInt64(n[0])
+	case 2:
+		start, end = conv.ToInt64(n[0]), conv.ToInt64(n[1])
+	default:
+		start, end, step = conv.ToInt64(n[0]), conv.ToInt64(n[1]), conv.ToInt64(n[2])
+	}
+	size, stride := end-start, step
+	if size < 0 {
+		size = -size
+	}
+	if stride < 0 {
+		stride = -stride
+	}
+	if stride == 0 || size/stride >= maxSeq {
+		return nil, errors.Errorf("seq from %d to %d exceeds the sandbox limit of %d elements", start, end, maxSeq)
+	}
+	return (&funcs.MathFuncs{}).Seq(start, end, step)
+}
+
+// sandboxStrings is the strings namespace with the length of the strings it grows capped
+type sandboxStrings struct {
+	*funcs.StringFuncs
+}
+
+func (s sandboxStrings) Repeat(count int, in interface{}) (string, error) {
+	if err := checkGrowth("repeat", 0, count, len(conv.ToString(in))); err != nil {
+		return "", err
+	}
+	return s.StringFuncs.Repeat(count, in)
+}
+
+func (s sandboxStrings) Indent(args ...interface{}) (string, error) {
+	if len(args) >= 2 {
+		width, indent := 1, " "
+		switch arg := args[0].(type) {
+		case int:
+			width = arg
+		case string:
+			indent = arg
+		}
+		if len(args) == 3 {
+			indent, _ = args[1].(string)
+		}
+		in := conv.ToString(args[len(args)-1])
+		if width > maxString {
+			width = maxString + 1
+		}
+		if err := checkGrowth("indent", len(in), strings.Count(in, "\n")+1, width*len(indent)); err != nil {
+			return "", err
+		}
+	}
+	return s.StringFuncs.Indent(args...)
+}
+
+// WordWrap is capped as each space that is wrapped at is replaced by the line break sequence
+func (s sandboxStrings) WordWrap(args ...interface{}) (string, error) {
+	if len(args) >= 2 {
+		lbseq, _ := args[0].(string)
+		if len(args) == 3 {
+			lbseq = conv.ToString(args[1])
+		}
+		in := conv.ToString(args[len(args)-1])
+		if err := checkGrowth("wordWrap", len(in), strings.Count(in, " "), len(lbseq)-1); err != nil {
+			return "", err
+		}
+	}
+	return s.StringFuncs.WordWrap(args...)
+}
+
+func (s sandboxStrings) ReplaceAll(old, new string, in interface{}) (string, error) {
+	input := conv.ToString(in)
+	if err := checkGrowth("replaceAll", len(input), strings.Count(input, old), len(new)-len(old)); err != nil {
+		return "", err
+	}
+	return s.StringFuncs.ReplaceAll(old, new, input), nil
+}
+
+// sandboxRegexp is the regexp namespace with the length of replacements capped
+type sandboxRegexp struct {
+	*funcs.ReFuncs
+}
+
+func (r sandboxRegexp) Replace(re, replacement, input interface{}) (string, error) {
+	return r.replace(conv.ToString(re), conv.ToString(replacement), conv.ToString(input), false)
+}
+
+func (r sandboxRegexp) ReplaceLiteral(re, replacement, input interface{}) (string, error) {
+	return r.replace(conv.ToString(re), conv.ToString(replacement), conv.ToString(input), true)
+}
+
+func (sandboxRegexp) replace(expression, replacement, input string, literal bool) (string, error) {
+	re, err := regexp.Compile(expression)
+	if err != nil {
+		return "", err
+	}
+	added := 0
+	for _, match := range re.FindAllStringIndex(input, -1) {
+		added += len(replacement)
+		if !literal {
+			// each reference in the replacement expands to at most the length of its match
+			added += strings.Count(replacement, "$") * (match[1] - match[0])
+		}
+		if added > maxString {
+			break
+		}
+	}
+	if err := checkGrowth("regexp.Replace", len(input), 1, added); err != nil {
+		return "", err
+	}
+	if literal {
+		return re.ReplaceAllLiteralString(input, replacement), nil
+	}
+	return re.ReplaceAllString(input, replacement), nil
+}
+
+// countIterations adds a call to iterationFunction to the start of each range body and each
+// template other than tpl, so that loops and recursion are counted even if they call no functions
+func countIterations(tpl *template.Template) error {
+	call, err := parse.New("sandbox").Parse("{{"+iterationFunction+"}}", "", "", map[string]*parse.Tree{},
+		map[string]interface{}{iterationFunction: true})
+	if err != nil {
+		return err
+	}
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil || t.Tree.Root == nil {
+			continue
+		}
+		countRanges(t.Tree.Root, call.Root.Nodes[0])
+		if t.Name() != tpl.Name() {
+			t.Tree.Root.Nodes = append([]parse.Node{call.Root.Nodes[0]}, t.Tree.Root.Nodes...)
+		}
+	}
+	return nil
+}
+
+func countRanges(node parse.Node, call parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			countRanges(child, call)
+		}
+	case *parse.IfNode:
+		countRanges(n.List, call)
+		countRanges(n.ElseList, call)
+	case *parse.WithNode:
+		countRanges(n.List, call)
+		countRanges(n.ElseList, call)
+	case *parse.RangeNode:
+		countRanges(n.List, call)
+		countRanges(n.ElseList, call)
+		n.List.Nodes = append([]parse.Node{call}, n.List.Nodes...)
+	}
+}
+
+// guard returns fn wrapped so that it fails with ErrTimeout once done is closed
+func guard(fn interface{}, done <-chan struct{}) interface{} {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return fn
+	}
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		select {
+		case <-done:
+			// text/template returns a panic in a function as the error of the call
+			panic(ErrTimeout)
+		default:
+		}
+		if v.Type().IsVariadic() {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	}).Interface()
+}
+
+// allowLookup returns an error unless a rule allows reading mapping in namespace, an empty
+// namespace lists all namespaces
+func (f *Functions) allowLookup(mapping *meta.RESTMapping, namespace string) error {
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	for _, rule := range f.Sandbox.Lookups {
+		if !f.ruleAllowsKind(rule, mapping) {
+			continue
+		}
+		if len(rule.Namespaces) == 0 {
+			return nil
+		}
+		if !namespaced {
+			continue
+		}
+		for _, allowed := range rule.Namespaces {
+			if allowed == namespace {
+				return nil
+			}
+		}
+	}
+	if namespaced && namespace == "" {
+		return errors.Errorf("sandbox does not allow listing %s in all namespaces", mapping.Resource.GroupResource())
+	}
+	if namespaced {
+		return errors.Errorf("sandbox does not allow reading %s in namespace %s", mapping.Resource.GroupResource(), namespace)
+	}
+	return errors.Errorf("sandbox does not allow reading %s", mapping.Resource.GroupResource())
+}
+
+func (f *Functions) ruleAllowsKind(rule LookupRule, mapping *meta.RESTMapping) bool {
+	if len(rule.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range rule.Kinds {
+		allowed, err := f.mappingFor(kind)
+		if err == nil && allowed.GroupVersionKind.GroupKind() == mapping.GroupVersionKind.GroupKind() {
+			return true
+		}
+	}
+	return false
+}
+
+// execute runs tpl within the output and time limits of the sandbox, fm are the sandboxed
+// functions tpl was parsed with
+func (s *Sandbox) execute(tpl *template.Template, fm template.FuncMap, data interface{}) (string, error) {
+	done := make(chan struct{})
+	out := &limitedBuffer{limit: s.MaxOutput, done: done}
+	if err := countIterations(tpl); err != nil {
+		return "", err
+	}
+	iterations := 0
+	iterate := func() (string, error) {
+		select {
+		case <-done:
+			return "", ErrTimeout
+		default:
+		}
+		iterations++
+		if iterations > maxIterations {
+			return "", errors.Errorf("template exceeds the sandbox limit of %d iterations", maxIterations)
+		}
+		return "", nil
+	}
+	if s.Timeout <= 0 {
+		tpl.Funcs(template.FuncMap{iterationFunction: iterate})
+		err := tpl.Execute(out, data)
+		return out.String(), err
+	}
+
+	guarded := make(template.FuncMap, len(fm)+1)
+	for name, fn := range fm {
+		guarded[name] = guard(fn, done)
+	}
+	guarded[iterationFunction] = iterate
+	tpl.Funcs(guarded)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tpl.Execute(out, data)
+	}()
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return out.String(), err
+	case <-timer.C:
+		// templates cannot be cancelled, so the render is stopped at its next iteration, write or function call
+		close(done)
+		return "", fmt.Errorf("%w after %v", ErrTimeout, s.Timeout)
+	}
+}
+
+// limitedBuffer fails writes once limit bytes have been written or done is closed
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+	done  chan struct{}
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	select {
+	case <-b.done:
+		return 0, ErrTimeout
+	default:
+	}
+	if b.limit > 0 && b.Len()+len(p) > b.limit {
+		return 0, fmt.Errorf("%w of %d bytes", ErrOutputLimit, b.limit)
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,185 @@
+package ktemplate
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSandboxFunctions(t *testing.T) {
+	f := newTestFunctions()
+	f.Sandbox = &Sandbox{}
+	f.Custom = map[string]interface{}{"greeting": func() string { return "hello" }}
+
+	out, err := f.Template(`{{ greeting }} {{ toUpper .name }} {{ add 1 2 }} {{ strings.TrimSpace " x " }}`, map[string]string{"name": "web"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello WEB 3 x", out)
+
+	for _, tpl := range []string{
+		`{{ filepath.Glob "/etc/*" }}`,
+		`{{ random.Alpha 5 }}`,
+		`{{ time.Now }}`,
+		`{{ coll.JQ "$ENV" . }}`,
+		`{{ kget "secret/default/db" "password" }}`,
+	} {
+		_, err := f.Template(tpl, nil)
+		if assert.Error(t, err, tpl) {
+			assert.Contains(t, err.Error(), "not defined", tpl)
+		}
+	}
+
+	f.Sandbox = &Sandbox{Functions: []string{"toUpper"}}
+	_, err = f.Template(`{{ toLower "A" }}`, nil)
+	assert.Error(t, err)
+	out, err = f.Template(`{{ toUpper "a" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "A", out)
+}
+
+func TestSandboxLookups(t *testing.T) {
+	f := newTestFunctions(
+		newObject("v1", "ConfigMap", "team-a", "settings", map[string]interface{}{"data": map[string]interface{}{"key": "a"}}),
+		newObject("v1", "ConfigMap", "team-b", "settings", map[string]interface{}{"data": map[string]interface{}{"key": "b"}}),
+		newObject("v1", "Secret", "team-a", "db", map[string]interface{}{"data": map[string]interface{}{"password": "c2VjcmV0"}}),
+		newObject("v1", "Namespace", "", "team-a", nil),
+	)
+	f.Strict = true
+	f.Sandbox = &Sandbox{Lookups: []LookupRule{
+		{Kinds: []string{"configmap"}, Namespaces: []string{"team-a"}},
+		{Kinds: []string{"namespaces"}},
+	}}
+
+	allowed := map[string]string{
+		`{{ kget "configmaps/team-a/settings" "data.key" }}`:                   "a",
+		`{{ kget "ConfigMap/team-a/settings" "data.key" }}`:                    "a",
+		`{{ len (klist "configmap/team-a") }}`:                                 "1",
+		`{{ kget "namespace//team-a" "metadata.name" }}`:                       "team-a",
+		`{{ kgetDefault "configmap/team-b/settings" "data.key" "denied" }}`:    "denied",
+		`{{ kgetDefault "configmap/team-a/missing" "data.key" "not found" }}`:  "not found",
+		`{{ kgetDefault "secret/team-a/db" "password" "secrets are denied" }}`: "secrets are denied",
+	}
+	for tpl, expected := range allowed {
+		out, err := f.Template(tpl, nil)
+		assert.NoError(t, err, tpl)
+		assert.Equal(t, expected, out, tpl)
+	}
+
+	for tpl, message := range map[string]string{
+		`{{ kget "configmap/team-b/settings" "data.key" }}`: "sandbox does not allow reading configmaps in namespace team-b",
+		`{{ klist "configmap" }}`:                           "sandbox does not allow listing configmaps in all namespaces",
+		`{{ kget "secret/team-a/db" "password" }}`:          "sandbox does not allow reading secrets in namespace team-a",
+	} {
+		_, err := f.Template(tpl, nil)
+		if assert.Error(t, err, tpl) {
+			assert.Contains(t, err.Error(), message, tpl)
+		}
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	f := NewFunctions(nil)
+	f.Sandbox = &Sandbox{MaxOutput: 10}
+	out, err := f.Template(`{{ range seq 1 5 }}x{{ end }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "xxxxx", out)
+
+	_, err = f.Template(`{{ range seq 1 20 }}x{{ end }}`, nil)
+	assert.True(t, errors.Is(err, ErrOutputLimit), "%v", err)
+
+	f.Sandbox = &Sandbox{Timeout: 50 * time.Millisecond}
+	f.Custom = map[string]interface{}{"slow": func() string {
+		time.Sleep(time.Second)
+		return ""
+	}}
+	start := time.Now()
+	_, err = f.Template(`{{ slow }}`, nil)
+	assert.True(t, errors.Is(err, ErrTimeout), "%v", err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestSandboxStopsAfterTimeout(t *testing.T) {
+	var calls int64
+	f := NewFunctions(nil)
+	f.Sandbox = &Sandbox{Timeout: 50 * time.Millisecond}
+	f.Custom = map[string]interface{}{"tick": func() string {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(time.Millisecond)
+		return ""
+	}}
+	_, err := f.Template(`{{ range seq 1 5000 }}{{ $_ := tick }}{{ end }}`, nil)
+	assert.True(t, errors.Is(err, ErrTimeout), "%v", err)
+
+	// the render stops at the next call, rather than running to completion in the background
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt64(&calls)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt64(&calls), "tick was called after the timeout")
+	assert.Less(t, stopped, int64(5000))
+}
+
+func TestSandboxCaps(t *testing.T) {
+	f := NewFunctions(nil)
+	f.Sandbox = &Sandbox{}
+	out, err := f.Template(`{{ len (seq 1 100) }} {{ len (math.Seq 10 1 -1) }} {{ strings.Repeat 3 "ab" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "100 10 ababab", out)
+	out, err = f.Template(`{{ indent 2 "a\nb" }},{{ strings.Indent 1 "-" "c" }},{{ strings.WordWrap 3 "ab cd" }},{{ replaceAll "a" "bb" "aa" }},{{ regexp.Replace "a(.)" "$1" "abac" }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "  a\n  b,-c,ab\ncd,bbbb,bc", out)
+
+	for _, tpl := range []string{
+		`{{ range seq 1 100000000 }}{{ end }}`,
+		`{{ range seq 100000000 }}{{ end }}`,
+		`{{ range math.Seq 1 100000000 }}{{ end }}`,
+		`{{ range seq 1 10 0 }}{{ end }}`,
+		`{{ strings.Repeat 100000000 "ab" }}`,
+		`{{ $x := indent 200000000 "x" }}`,
+		`{{ strings.Indent 200000000 "x" }}`,
+		`{{ strings.Indent 2000 (strings.Repeat 2000 "-") (strings.Repeat 2000 "\n") }}`,
+		`{{ strings.WordWrap 1 (strings.Repeat 2000 "-") (strings.Repeat 2000 "a ") }}`,
+		`{{ replaceAll "" (strings.Repeat 2000 "-") (strings.Repeat 2000 "a") }}`,
+		`{{ strings.ReplaceAll "a" (strings.Repeat 2000 "-") (strings.Repeat 2000 "a") }}`,
+		`{{ regexp.Replace "" (strings.Repeat 2000 "-") (strings.Repeat 2000 "a") }}`,
+		`{{ regexp.Replace "a+" (strings.Repeat 2000 "$0") (strings.Repeat 2000 "a") }}`,
+		`{{ regexp.ReplaceLiteral "" (strings.Repeat 2000 "-") (strings.Repeat 2000 "a") }}`,
+	} {
+		_, err := f.Template(tpl, nil)
+		if assert.Error(t, err, tpl) {
+			assert.Contains(t, err.Error(), "exceeds the sandbox limit", tpl)
+		}
+	}
+}
+
+func TestSandboxIterations(t *testing.T) {
+	f := NewFunctions(nil)
+	f.Sandbox = &Sandbox{}
+	out, err := f.Template(`{{ define "item" }}{{ . }}{{ end }}{{ range seq 3 }}{{ range seq . }}{{ template "item" . }}{{ end }};{{ end }}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1;12;123;", out)
+
+	// each level of nesting doubles the number of template calls
+	nested := map[string]interface{}{}
+	for i := 0; i < 40; i++ {
+		nested = map[string]interface{}{"next": nested}
+	}
+	for _, tpl := range []string{
+		`{{ $s := seq 9999 }}{{ range $s }}{{ range $s }}{{ range $s }}{{ end }}{{ end }}{{ end }}`,
+		`{{ range 1000000000 }}{{ end }}`,
+		`{{ define "loop" }}{{ with .next }}{{ template "loop" . }}{{ template "loop" . }}{{ end }}{{ end }}{{ template "loop" . }}`,
+	} {
+		start := time.Now()
+		_, err := f.Template(tpl, nested)
+		if assert.Error(t, err, tpl) {
+			assert.Contains(t, err.Error(), "iterations", tpl)
+		}
+		assert.Less(t, time.Since(start), 5*time.Second, tpl)
+	}
+
+	// loops that call no functions are stopped at the timeout
+	f.Sandbox.Timeout = 10 * time.Millisecond
+	_, err = f.Template(`{{ range 90000 }}{{ end }}`, nil)
+	assert.True(t, errors.Is(err, ErrTimeout), "%v", err)
+}
@@ -6,20 +6,38 @@ import (
 	"text/template"
 
 	"github.com/mitchellh/reflectwalk"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type StructTemplater struct {
 	Values    map[string]interface{}
 	Clientset *kubernetes.Clientset
-	functions *Functions
+	// DynamicClient and RESTMapper are used by kget, if not specified they are created from
+	// RESTConfig and Clientset respectively. With only a Clientset, kget and klist can read
+	// configmaps, secrets and services
+	DynamicClient dynamic.Interface
+	RESTMapper    meta.RESTMapper
+	RESTConfig    *rest.Config
+	functions     *Functions
 	// IgnoreFields from walking where key is field name and value is field type
 	IgnoreFields map[string]string
 	Funcs        template.FuncMap
 	DelimSets    []Delims
 	// If specified create a function for each value so that is can be accessed via {{ value }} in addition to {{ .value }}
 	ValueFunctions bool
-	RequiredTag    string
+	// RequiredTag only templates fields tagged with RequiredTag:"true", fields tagged with template:"-" are never templated
+	RequiredTag string
+	// Strict makes failed kget and klist lookups return an error rather than an empty value
+	Strict bool
+	// Cache is shared by renders to avoid reading the same objects again until its TTL expires
+	Cache *LookupCache
+	// Sandbox restricts the functions and lookups available to templates and limits their output and run time
+	Sandbox *Sandbox
+	// validation collects the errors found by Validate, templates are left unchanged while it is set
+	validation *ValidationErrors
 }
 
 type Delims struct {
@@ -36,99 +54,202 @@ func (w StructTemplater) StructField(f reflect.StructField, v reflect.Value) err
 		return nil
 	}
 
+	if w.skipField(f) {
+		return reflectwalk.SkipEntry
+	}
+
+	// let reflectwalk walk into nested structs so that their fields are templated in place
+	if v.Kind() == reflect.Struct || (v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct) {
+		return nil
+	}
+
+	val, err := w.templateValue(v)
+	if err != nil {
+		return err
+	}
+	if w.validation == nil {
+		v.Set(val)
+	}
+	// the value has been templated at every depth, so it is not walked again
+	return reflectwalk.SkipEntry
+}
+
+func (w StructTemplater) skipField(f reflect.StructField) bool {
+	if f.Tag.Get("template") == "-" {
+		return true
+	}
 	for key, value := range w.IgnoreFields {
 		if key == f.Name && value == f.Type.String() {
-			return reflectwalk.SkipEntry
+			return true
 		}
 	}
+	return w.RequiredTag != "" && f.Tag.Get(w.RequiredTag) != "true"
+}
 
-	if w.RequiredTag != "" && f.Tag.Get(w.RequiredTag) != "true" {
-		return reflectwalk.SkipEntry
-	}
-
+// templateValue returns a copy of v with every string in it templated, including strings in slices,
+// maps, interfaces and structs at any depth
+func (w StructTemplater) templateValue(v reflect.Value) (reflect.Value, error) {
 	switch v.Kind() {
 	case reflect.String:
 		val, err := w.Template(v.String())
 		if err != nil {
-			return err
+			return reflect.Value{}, err
 		}
-		v.SetString(val)
+		return reflect.ValueOf(val).Convert(v.Type()), nil
 
-	case reflect.Map:
-		if len(v.MapKeys()) != 0 {
-			newMap := reflect.MakeMap(v.Type())
-			for _, key := range v.MapKeys() {
-				val := v.MapIndex(key)
-				newKey, err := w.templateKey(key)
-				if err != nil {
-					return err
-				}
-
-				if val.Kind() == reflect.String {
-					newVal, err := w.Template(val.String())
-					if err != nil {
-						return err
-					}
-					newMap.SetMapIndex(newKey, reflect.ValueOf(newVal))
-				} else {
-					newMap.SetMapIndex(newKey, val)
-				}
-			}
-			v.Set(newMap)
+	case reflect.Interface:
+		if v.IsNil() {
+			return v, nil
 		}
-	}
-
-	return nil
-}
+		val, err := w.templateValue(v.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		newVal := reflect.New(v.Type()).Elem()
+		newVal.Set(val)
+		return newVal, nil
 
-func (w StructTemplater) templateKey(v reflect.Value) (reflect.Value, error) {
-	if v.Kind() == reflect.String {
-		key, err := w.Template(v.String())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v, nil
+		}
+		val, err := w.templateValue(v.Elem())
 		if err != nil {
 			return reflect.Value{}, err
 		}
-		return reflect.ValueOf(key), nil
+		if w.validation == nil {
+			v.Elem().Set(val)
+		}
+		return v, nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return v, nil
+		}
+		var newSlice reflect.Value
+		if v.Kind() == reflect.Slice {
+			newSlice = reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		} else {
+			newSlice = reflect.New(v.Type()).Elem()
+		}
+		for i := 0; i < v.Len(); i++ {
+			val, err := w.templateValue(v.Index(i))
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			newSlice.Index(i).Set(val)
+		}
+		return newSlice, nil
+
+	case reflect.Map:
+		if len(v.MapKeys()) == 0 {
+			return v, nil
+		}
+		newMap := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			newKey, err := w.templateValue(key)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			newVal, err := w.templateValue(v.MapIndex(key))
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			newMap.SetMapIndex(newKey, newVal)
+		}
+		return newMap, nil
+
+	case reflect.Struct:
+		// structs in maps and interfaces cannot be set in place, so template a copy
+		newStruct := reflect.New(v.Type()).Elem()
+		newStruct.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			field := newStruct.Field(i)
+			if !field.CanSet() || w.skipField(v.Type().Field(i)) {
+				continue
+			}
+			val, err := w.templateValue(field)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			field.Set(val)
+		}
+		return newStruct, nil
 	}
 	return v, nil
 }
 
+// Walk templates the fields of object as a single render, so each object looked up by kget
+// and klist is only read once
 func (w StructTemplater) Walk(object interface{}) error {
-	return reflectwalk.Walk(object, w)
+	_, err := w.WalkWithDependencies(object)
+	return err
+}
+
+// WalkWithDependencies is Walk that also returns the objects looked up while templating, so that
+// callers can template object again when they change
+func (w StructTemplater) WalkWithDependencies(object interface{}) ([]Dependency, error) {
+	w.functions = w.newFunctions()
+	if err := reflectwalk.Walk(object, w); err != nil {
+		return nil, err
+	}
+	return w.functions.Dependencies(), nil
+}
+
+func (w StructTemplater) newFunctions() *Functions {
+	functions := NewFunctionsWithDynamicClient(w.Clientset, w.DynamicClient, w.RESTMapper)
+	functions.RESTConfig = w.RESTConfig
+	functions.Custom = w.Funcs
+	functions.Strict = w.Strict
+	functions.SharedCache = w.Cache
+	functions.Sandbox = w.Sandbox
+
+	if w.ValueFunctions {
+		if functions.Custom == nil {
+			functions.Custom = make(template.FuncMap)
+		}
+		for k, v := range w.Values {
+			_v := v
+			functions.Custom[k] = func() interface{} {
+				return _v
+			}
+		}
+	}
+	return functions
 }
 
 func (w StructTemplater) Template(val string) (string, error) {
 	if strings.TrimSpace(val) == "" {
 		return val, nil
 	}
-	if w.functions == nil {
-		w.functions = NewFunctions(w.Clientset)
-		w.functions.Custom = w.Funcs
-
-		if w.ValueFunctions {
-			if w.functions.Custom == nil {
-				w.functions.Custom = make(template.FuncMap)
-			}
-			for k, v := range w.Values {
-				_v := v
-				w.functions.Custom[k] = func() interface{} {
-					return _v
-				}
-			}
+	if w.validation != nil {
+		err := w.ValidateTemplate(val)
+		if errs, ok := err.(ValidationErrors); ok {
+			*w.validation = append(*w.validation, errs...)
+			return val, nil
 		}
+		return val, err
 	}
-	if len(w.DelimSets) == 0 {
-		w.DelimSets = []Delims{{Left: "{{", Right: "}}"}}
+	if w.functions == nil {
+		w.functions = w.newFunctions()
 	}
 
 	var err error
 
-	for _, delims := range w.DelimSets {
+	for _, delims := range w.delimSets() {
 		w.functions.LeftDelim = delims.Left
 		w.functions.RightDelim = delims.Right
-		val, err = w.functions.Template(val, w.Values)
+		val, err = w.functions.render(val, w.Values)
 		if err != nil {
 			return val, err
 		}
 	}
 	return val, nil
 }
+
+func (w StructTemplater) delimSets() []Delims {
+	if len(w.DelimSets) == 0 {
+		return []Delims{{Left: "{{", Right: "}}"}}
+	}
+	return w.DelimSets
+}
@@ -121,3 +121,69 @@ func TestMain(t *testing.T) {
 		})
 	}
 }
+
+type Container struct {
+	Name string
+	Args []string
+	Env  map[string]string
+}
+
+type Nested struct {
+	Hosts      []string
+	Containers []Container
+	Options    map[string][]string
+	Config     map[string]interface{}
+	Sidecars   map[string]Container
+	Script     string `template:"-"`
+	Version    string
+	Image      *string
+	Command    *[]string
+	Tag        *string
+	Main       *Container
+}
+
+func TestNested(t *testing.T) {
+	templater := StructTemplater{
+		Values: map[string]interface{}{"env": "prod", "version": "1.2"},
+	}
+	image, expectedImage := "web:{{.version}}", "web:1.2"
+	command, expectedCommand := []string{"run", "--env={{.env}}"}, []string{"run", "--env=prod"}
+	input := &Nested{
+		Hosts:      []string{"web.{{.env}}", "api.{{.env}}"},
+		Containers: []Container{{Name: "{{.env}}-web", Args: []string{"--env={{.env}}"}, Env: map[string]string{"ENV": "{{.env}}"}}},
+		Options:    map[string][]string{"{{.env}}": {"a-{{.env}}"}},
+		Config: map[string]interface{}{
+			"replicas": 3,
+			"empty":    nil,
+			"image":    map[string]interface{}{"tag": "{{.version}}", "pull": []interface{}{"{{.env}}", true}},
+		},
+		Sidecars: map[string]Container{"proxy": {Name: "proxy-{{.env}}"}},
+		Script:   "echo {{.env}}",
+		Version:  "{{.version}}",
+		Image:    &image,
+		Command:  &command,
+		Main:     &Container{Name: "{{.env}}-main"},
+	}
+	expected := &Nested{
+		Hosts:      []string{"web.prod", "api.prod"},
+		Containers: []Container{{Name: "prod-web", Args: []string{"--env=prod"}, Env: map[string]string{"ENV": "prod"}}},
+		Options:    map[string][]string{"prod": {"a-prod"}},
+		Config: map[string]interface{}{
+			"replicas": 3,
+			"empty":    nil,
+			"image":    map[string]interface{}{"tag": "1.2", "pull": []interface{}{"prod", true}},
+		},
+		Sidecars: map[string]Container{"proxy": {Name: "proxy-prod"}},
+		Script:   "echo {{.env}}",
+		Version:  "1.2",
+		Image:    &expectedImage,
+		Command:  &expectedCommand,
+		Main:     &Container{Name: "prod-main"},
+	}
+	if err := templater.Walk(input); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expected, input); diff != "" {
+		t.Error(diff)
+	}
+}
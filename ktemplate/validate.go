@@ -0,0 +1,115 @@
+package ktemplate
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/reflectwalk"
+)
+
+// ValidationError is a template that failed to parse or execute
+type ValidationError struct {
+	Template string
+	Delims   Delims
+	// Line and Column are relative to the start of the template, Column is 0 for parse errors
+	Line, Column int
+	Message      string
+}
+
+func (e *ValidationError) Error() string {
+	position := strconv.Itoa(e.Line)
+	if e.Column > 0 {
+		position += ":" + strconv.Itoa(e.Column)
+	}
+	return fmt.Sprintf("invalid template %s: %s: %s", strings.Split(e.Template, "\n")[0], position, e.Message)
+}
+
+// ValidationErrors are all the invalid templates found by StructTemplater.Validate
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// errorPosition matches the position text/template prefixes to parse and execution errors, e.g.
+// template: :3: function "foo" not defined or template: :1:2: executing "" at <.foo>: map has no entry for key "foo"
+var errorPosition = regexp.MustCompile(`^template: [^:]*:(\d+)(?::(\d+))?: (?:executing "[^"]*" )?`)
+
+func newValidationError(template string, delims Delims, err error) *ValidationError {
+	e := &ValidationError{Template: template, Delims: delims, Message: err.Error()}
+	if match := errorPosition.FindStringSubmatch(e.Message); match != nil {
+		e.Line, _ = strconv.Atoi(match[1])
+		e.Column, _ = strconv.Atoi(match[2])
+		e.Message = e.Message[len(match[0]):]
+	}
+	return e
+}
+
+// Validate parses and executes template without accessing the cluster, kget and klist return
+// empty values. Unlike Template, keys missing from vars are an error rather than "<no value>".
+// Failures are returned as a *ValidationError
+func (f *Functions) Validate(template string, vars interface{}) error {
+	_, err := f.validate(template, vars)
+	return err
+}
+
+func (f *Functions) validate(template string, vars interface{}) (string, error) {
+	delims := Delims{Left: f.LeftDelim, Right: f.RightDelim}
+	fm := f.funcMap(true, nil)
+	tpl, err := f.parse(template, fm)
+	if err != nil {
+		return template, newValidationError(template, delims, err)
+	}
+	unstructured, err := toUnstructured(vars)
+	if err != nil {
+		return template, err
+	}
+	out, err := f.execute(tpl.Option("missingkey=error"), fm, unstructured)
+	if err != nil {
+		return template, newValidationError(template, delims, err)
+	}
+	return out, nil
+}
+
+// Validate checks every templated field of object with each of the DelimSets without modifying
+// it or accessing the cluster, returning ValidationErrors listing each invalid template
+func (w StructTemplater) Validate(object interface{}) error {
+	w.validation = &ValidationErrors{}
+	w.functions = w.newFunctions()
+	if err := reflectwalk.Walk(object, w); err != nil {
+		return err
+	}
+	if len(*w.validation) == 0 {
+		return nil
+	}
+	return *w.validation
+}
+
+// ValidateTemplate checks val with each of the DelimSets, the output of each set is validated with the next
+func (w StructTemplater) ValidateTemplate(val string) error {
+	if w.functions == nil {
+		w.functions = w.newFunctions()
+	}
+	var errs ValidationErrors
+	for _, delims := range w.delimSets() {
+		w.functions.LeftDelim = delims.Left
+		w.functions.RightDelim = delims.Right
+		out, err := w.functions.validate(val, w.Values)
+		if v, ok := err.(*ValidationError); ok {
+			errs = append(errs, v)
+		} else if err != nil {
+			return err
+		}
+		val = out
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,105 @@
+package ktemplate
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	f := NewFunctions(nil)
+	vars := map[string]interface{}{"name": "web", "image": map[string]interface{}{"tag": "1.2"}}
+
+	tests := []struct {
+		template     string
+		line, column int
+		message      string
+	}{
+		{template: `{{ .name }}:{{ .image.tag }}`},
+		{template: `{{ kget "secret/default/db" "password" }}{{ range klist "configmap" }}{{ end }}`},
+		{template: "name: {{ .name }}\nport: {{ .port }}", line: 2, column: 9, message: `at <.port>: map has no entry for key "port"`},
+		{template: `{{ .image.digest }}`, line: 1, column: 9, message: `map has no entry for key "digest"`},
+		{template: "a\nb\n{{ unknown .name }}", line: 3, message: `function "unknown" not defined`},
+		{template: `{{ $missing }}`, line: 1, message: `undefined variable "$missing"`},
+		{template: `{{ if .name }}`, line: 1, message: "unexpected EOF"},
+	}
+	for _, test := range tests {
+		err := f.Validate(test.template, vars)
+		if test.message == "" {
+			assert.NoError(t, err, test.template)
+			continue
+		}
+		var v *ValidationError
+		if !errors.As(err, &v) {
+			t.Errorf("%s: expected a ValidationError, got %v", test.template, err)
+			continue
+		}
+		assert.Equal(t, test.line, v.Line, test.template)
+		assert.Equal(t, test.column, v.Column, test.template)
+		assert.Contains(t, v.Message, test.message, test.template)
+	}
+
+	out, err := f.Template(`{{ .port }}`, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "<no value>", out, "Template should not be affected by validation")
+}
+
+func TestStructTemplaterValidate(t *testing.T) {
+	templater := StructTemplater{
+		RequiredTag: "template",
+		DelimSets: []Delims{
+			{Left: "{{", Right: "}}"},
+			{Left: "$(", Right: ")"},
+		},
+		Values:         map[string]interface{}{"msg": "world"},
+		ValueFunctions: true,
+	}
+	input := &Test{
+		Template:   "hello $(msg) {{ .missing }}",
+		NoTemplate: "{{ .ignored }}",
+		Labels: map[string]string{
+			"ok":    "{{ .msg }} $(msg)",
+			"first": "$(unknown)",
+		},
+	}
+	err := templater.Validate(input)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	assert.Equal(t, 2, len(errs), err.Error())
+	messages := map[string]Delims{}
+	for _, e := range errs {
+		messages[e.Message] = e.Delims
+	}
+	assert.Equal(t, Delims{Left: "{{", Right: "}}"}, messages[`at <.missing>: map has no entry for key "missing"`])
+	assert.Equal(t, Delims{Left: "$(", Right: ")"}, messages[`function "unknown" not defined`])
+	assert.Equal(t, "hello $(msg) {{ .missing }}", input.Template, "Validate should not modify the object")
+	assert.Equal(t, "$(unknown)", input.Labels["first"])
+
+	assert.NoError(t, templater.Validate(&Test{Template: "hello $(msg) {{ .msg }}"}))
+}
+
+func TestValidateConcurrentTemplate(t *testing.T) {
+	f := newTestFunctions(newObject("v1", "ConfigMap", "default", "settings", map[string]interface{}{
+		"data": map[string]interface{}{"key": "value"},
+	}))
+	template := `{{ kget "configmap/default/settings" "data.key" }}`
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, f.Validate(template, nil))
+		}()
+		go func() {
+			defer wg.Done()
+			out, err := f.Template(template, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, "value", out, "Template should not be affected by a concurrent validation")
+		}()
+	}
+	wg.Wait()
+}
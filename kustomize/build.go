@@ -0,0 +1,77 @@
+package kustomize
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+)
+
+// IsKustomization returns true if dir contains a kustomization file
+func IsKustomization(fs filesys.FileSystem, dir string) bool {
+	for _, name := range KustomizationFileNames {
+		if fs.Exists(filepath.Join(dir, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build runs the kustomization in dir, including its resources, bases, components,
+// generators and transformers, and returns the resulting objects.
+// Files referenced by the kustomization must be within dir, with the exception of other kustomizations
+func Build(fs filesys.FileSystem, dir string) ([]*unstructured.Unstructured, error) {
+	if !IsKustomization(fs, dir) {
+		return nil, errors.Errorf("%s does not contain a kustomization file", dir)
+	}
+	resMap, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fs, dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build kustomization %s", dir)
+	}
+	var items []*unstructured.Unstructured
+	for _, r := range resMap.Resources() {
+		object, err := r.Map()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to convert %s", r.CurId())
+		}
+		items = append(items, &unstructured.Unstructured{Object: object})
+	}
+	return items, nil
+}
+
+// References returns the directories of the local kustomizations that the kustomization in dir
+// uses as resources, bases or components, remote references are ignored
+func References(fs filesys.FileSystem, dir string) ([]string, error) {
+	var data []byte
+	for _, name := range KustomizationFileNames {
+		if path := filepath.Join(dir, name); fs.Exists(path) {
+			var err error
+			if data, err = fs.ReadFile(path); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if data == nil {
+		return nil, errors.Errorf("%s does not contain a kustomization file", dir)
+	}
+	var kustomization types.Kustomization
+	if err := yaml.Unmarshal(data, &kustomization); err != nil {
+		return nil, errors.Wrapf(err, "invalid kustomization in %s", dir)
+	}
+
+	var references []string
+	for _, entries := range [][]string{kustomization.Resources, kustomization.Bases, kustomization.Components} { // nolint: staticcheck
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry)
+			if fs.IsDir(path) && IsKustomization(fs, path) {
+				references = append(references, path)
+			}
+		}
+	}
+	return references, nil
+}
@@ -0,0 +1,243 @@
+package kustomize
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/TomOnTime/utfutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Source is the location of an object in a manifest
+type Source struct {
+	// File is empty when decoding from a stream that is not backed by a file
+	File string
+	// Line is the 1-based line the object's document starts on
+	Line int
+}
+
+func (s Source) String() string {
+	if s.File == "" {
+		return fmt.Sprintf("line %d", s.Line)
+	}
+	return fmt.Sprintf("%s:%d", s.File, s.Line)
+}
+
+// DecodeError is an error decoding the document at Source
+type DecodeError struct {
+	Source
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Source, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Decoder reads objects from a stream of YAML documents or JSON objects, in UTF-8 or UTF-16
+// with LF, CRLF or CR line endings. Documents are read one at a time, so the stream is never
+// held in memory in its entirety
+type Decoder struct {
+	file   string
+	reader *bufio.Reader
+	// line is the number of lines read so far
+	line int
+	// next is the content following the separator that ended the previous document
+	next string
+	eof  bool
+	// pending are objects decoded from the current document that have not been returned yet,
+	// a JSON document can contain more than one object
+	pending []*unstructured.Unstructured
+	source  Source
+}
+
+// NewDecoder creates a Decoder reading from r, file is used to report the Source of objects and errors
+func NewDecoder(r io.Reader, file string) *Decoder {
+	return &Decoder{
+		file:   file,
+		reader: bufio.NewReader(newLfReader(utfutil.NewReader(r, utfutil.UTF8))),
+	}
+}
+
+// Decode returns the next object and its source, or io.EOF when there are no more objects.
+// Empty documents and documents that only contain comments are skipped
+func (d *Decoder) Decode() (*unstructured.Unstructured, Source, error) {
+	for len(d.pending) == 0 {
+		doc, start, err := d.readDocument()
+		if err != nil {
+			return nil, Source{}, err
+		}
+		if err := d.decodeDocument(doc, start); err != nil {
+			var source Source
+			if decodeErr, ok := err.(*DecodeError); ok {
+				source = decodeErr.Source
+			}
+			return nil, source, err
+		}
+		d.source = Source{File: d.file, Line: start + leadingLines(doc)}
+	}
+	obj := d.pending[0]
+	d.pending = d.pending[1:]
+	return obj, d.source, nil
+}
+
+// DecodeAll returns all of the remaining objects in the stream
+func (d *Decoder) DecodeAll() ([]*unstructured.Unstructured, error) {
+	var items []*unstructured.Unstructured
+	for {
+		obj, _, err := d.Decode()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, obj)
+	}
+}
+
+// readDocument returns the next document and the line it starts on, documents are separated by
+// lines starting with "---" or ending with "...", optionally followed by whitespace and content
+func (d *Decoder) readDocument() (string, int, error) {
+	if d.eof {
+		return "", 0, io.EOF
+	}
+	var doc strings.Builder
+	start := d.line + 1
+	if d.next != "" {
+		doc.WriteString(d.next)
+		start = d.line
+		d.next = ""
+	}
+	for {
+		line, err := d.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", 0, err
+		}
+		if line != "" {
+			d.line++
+		}
+		if rest, ok := documentSeparator(line); ok {
+			d.next = rest
+			return doc.String(), start, nil
+		}
+		if strings.TrimRight(line, " \t\n") == "..." {
+			return doc.String(), start, nil
+		}
+		doc.WriteString(line)
+		if err == io.EOF {
+			d.eof = true
+			return doc.String(), start, nil
+		}
+	}
+}
+
+// documentSeparator returns whether line starts a new document, and any content following the marker
+func documentSeparator(line string) (string, bool) {
+	if !strings.HasPrefix(line, "---") {
+		return "", false
+	}
+	rest := line[3:]
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' && rest[0] != '\n' {
+		return "", false
+	}
+	if strings.TrimSpace(rest) == "" {
+		return "", true
+	}
+	return strings.TrimLeft(rest, " \t"), true
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+): `)
+
+func (d *Decoder) decodeDocument(doc string, start int) error {
+	if strings.TrimSpace(doc) == "" {
+		return nil
+	}
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(doc), 4096)
+	for {
+		var resource *unstructured.Unstructured
+		err := decoder.Decode(&resource)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return d.decodeError(err, doc, start)
+		}
+		if resource != nil {
+			d.pending = append(d.pending, resource)
+		}
+	}
+}
+
+// decodeError converts a line or offset within doc into a line in the stream
+func (d *Decoder) decodeError(err error, doc string, start int) error {
+	source := Source{File: d.file, Line: start}
+	if syntax, ok := err.(yamlutil.JSONSyntaxError); ok && syntax.Offset <= int64(len(doc)) {
+		source.Line += bytes.Count([]byte(doc[:syntax.Offset]), []byte("\n"))
+		return &DecodeError{Source: source, Err: syntax.Err}
+	}
+	msg := err.Error()
+	if match := yamlErrorLine.FindStringSubmatchIndex(msg); match != nil {
+		line, _ := strconv.Atoi(msg[match[2]:match[3]])
+		source.Line += line - 1
+		err = fmt.Errorf("%s%s", msg[:match[0]], msg[match[1]:])
+	}
+	return &DecodeError{Source: source, Err: err}
+}
+
+// leadingLines counts the blank and comment lines before the content of doc
+func leadingLines(doc string) int {
+	n := 0
+	for _, line := range strings.SplitAfter(doc, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// lfReader converts CRLF and CR line endings to LF
+type lfReader struct {
+	reader *bufio.Reader
+}
+
+func newLfReader(r io.Reader) io.Reader {
+	return &lfReader{reader: bufio.NewReader(r)}
+}
+
+func (r *lfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		// return what has been read rather than blocking for more
+		if n > 0 && r.reader.Buffered() == 0 {
+			break
+		}
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b == '\r' {
+			if next, err := r.reader.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+			b = '\n'
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
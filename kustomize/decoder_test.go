@@ -0,0 +1,117 @@
+package kustomize
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const manifest = `# leading comment
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+data:
+  script: |
+    echo one
+
+    echo two
+--- # second document
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second
+---
+# only a comment
+---
+
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: third
+...
+--- {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "fourth"}}
+`
+
+func TestDecoder(t *testing.T) {
+	for name, input := range map[string]string{
+		"LF":   manifest,
+		"CRLF": strings.ReplaceAll(manifest, "\n", "\r\n"),
+		"CR":   strings.ReplaceAll(manifest, "\n", "\r"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			decoder := NewDecoder(strings.NewReader(input), "manifest.yaml")
+			var names []string
+			var sources []string
+			for {
+				obj, source, err := decoder.Decode()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, obj.GetName())
+				sources = append(sources, source.String())
+				if obj.GetName() == "first" {
+					assert.Equal(t, "echo one\n\necho two\n", obj.Object["data"].(map[string]interface{})["script"])
+				}
+			}
+			assert.Equal(t, []string{"first", "second", "third", "fourth"}, names)
+			assert.Equal(t, []string{"manifest.yaml:2", "manifest.yaml:12", "manifest.yaml:20", "manifest.yaml:25"}, sources)
+		})
+	}
+}
+
+func TestDecoderJSONStream(t *testing.T) {
+	items, err := NewDecoder(strings.NewReader(`{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "a"}}
+{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "b"}}`), "").DecodeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(items))
+	assert.Equal(t, "b", items[1].GetName())
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "yaml syntax",
+			input: "apiVersion: v1\nkind: ConfigMap\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: bad\n  labels: [\n",
+			err:   "deploy.yaml:8: ",
+		},
+		{
+			name:  "json syntax",
+			input: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n---\n{\n  \"kind\": \"Namespace\",\n  \"apiVersion\": v1\n}\n",
+			err:   "deploy.yaml:8: invalid character",
+		},
+		{
+			name:  "missing kind",
+			input: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n---\n\napiVersion: v1\nmetadata:\n  name: b\n",
+			err:   "Object 'Kind' is missing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewDecoder(strings.NewReader(test.input), "deploy.yaml").DecodeAll()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), test.err)
+			assert.True(t, strings.HasPrefix(err.Error(), "deploy.yaml:"), err.Error())
+			assert.NotContains(t, err.Error(), "apiVersion: v1", "errors should not echo the document")
+		})
+	}
+}
+
+func TestBytesToUtf8LfPreservesBlankLines(t *testing.T) {
+	got, err := BytesToUtf8Lf([]byte("a: 1\r\n\r\nb: |\r\n  x\r\n\r\n  y\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a: 1\n\nb: |\n  x\n\n  y\n", got)
+}
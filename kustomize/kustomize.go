@@ -18,35 +18,86 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
-	"regexp"
 	osruntime "runtime"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/TomOnTime/utfutil"
 	"github.com/flanksource/commons/logger"
 	"gopkg.in/yaml.v3"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 	"sigs.k8s.io/kustomize/api/krusty"
-	"sigs.k8s.io/kustomize/pkg/types"
-
+	"sigs.k8s.io/kustomize/api/types"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
 )
 
 // Manager define a manager that allow access to kustomize capabilities
 type Manager struct {
 	filesys.FileSystem
-	kustomizeDir          string
-	kustomizationFile     *types.Kustomization
-	strategicMergePatches strategicMergeSlice
-	json6902Patches       json6902Slice
+	// AnnotatePatches records the files of the patches applied to each object in the kustomize/patches annotation
+	AnnotatePatches bool
+	// Strict controls whether CheckPatches reports patches that did not match any object
+	Strict StrictMode
+	// lock guards the loaded patches and the match tracking, which are shared by concurrent runs
+	lock    sync.Mutex
+	patches []Patch
+	loaded  bool
+	matched map[int]bool
+	warned  map[string]bool
 }
 
 func (km *Manager) AddPatch(name string, data []byte) error {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.loaded = false
 	return km.WriteFile(name, data)
 }
 
+// GetPatches returns the patches contained in the Manager's FileSystem
+func (km *Manager) GetPatches() ([]Patch, error) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	return km.getPatches()
+}
+
+func (km *Manager) getPatches() ([]Patch, error) {
+	if km.loaded {
+		return km.patches, nil
+	}
+	patches, err := km.loadPatches()
+	if err != nil {
+		return nil, err
+	}
+	km.patches = patches
+	km.loaded = true
+	km.matched = nil
+	return patches, nil
+}
+
+// patchesFor returns the patches that target obj
+func (km *Manager) patchesFor(namespace string, obj *unstructured.Unstructured) ([]Patch, error) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	patches, err := km.getPatches()
+	if err != nil {
+		return nil, err
+	}
+	var matched []Patch
+	for i, patch := range patches {
+		ok, err := patch.Matches(namespace, obj)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			km.recordMatch(i, obj)
+			matched = append(matched, patch)
+		}
+	}
+	return matched, nil
+}
+
 var KustomizationFileNames = []string{
 	"kustomization.yaml",
 	"kustomization.yml",
@@ -75,7 +126,10 @@ func setAnnotation(obj *unstructured.Unstructured, key string, value string) {
 // Kustomize apply a set of patches to a resource.
 // Portions of the kustomize logic in this function are taken from the kubernetes-sigs/kind project
 func (km *Manager) Kustomize(namespace string, objects ...runtime.Object) ([]runtime.Object, error) {
-	var kustomized []runtime.Object
+	var resources []*unstructured.Unstructured
+	var batch []patchedObject
+	// batchIndex is the index in batch of each resource with patches, or -1
+	var batchIndex []int
 	for _, _resource := range objects {
 		resource := _resource.(*unstructured.Unstructured)
 
@@ -84,121 +138,185 @@ func (km *Manager) Kustomize(namespace string, objects ...runtime.Object) ([]run
 		}
 
 		// get patches corresponding to this resource
-		//strategicMerge := km.strategicMergePatches.filterByResource(namespace, resource)
-		//json6902 := km.json6902Patches.filterByResource(namespace, resource)
+		patches, err := km.patchesFor(namespace, resource)
+		if err != nil {
+			return nil, err
+		}
 
+		resources = append(resources, resource)
 		// if there are no patches, for the target resources, exit
-		//patchesCnt := len(strategicMerge) + len(json6902)
-
-		//if patchesCnt == 0 {
-		//kustomized = append(kustomized, resource)
-		//continue
-		//}
+		if len(patches) == 0 {
+			batchIndex = append(batchIndex, -1)
+			continue
+		}
 
 		setAnnotation(resource, "kustomize/patched", "true")
+		if km.AnnotatePatches {
+			setAnnotation(resource, PatchesAnnotation, patchFiles(patches))
+		}
+		batchIndex = append(batchIndex, len(batch))
+		batch = append(batch, patchedObject{resource, patches})
+	}
 
-		// create an in memory fs to use for the kustomization
-		fakeDir := "/"
-		// for Windows we need this to be a drive because kustomize uses filepath.Abs()
-		// which will add a drive letter if there is none. which drive letter is
-		// unimportant as the path is on the fake filesystem anyhow
-		if osruntime.GOOS == "windows" {
-			fakeDir = `C:\`
+	results, err := kustomizeBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	var kustomized []runtime.Object
+	for i, resource := range resources {
+		if batchIndex[i] < 0 {
+			kustomized = append(kustomized, resource)
+			continue
 		}
+		// a patch may delete its target, in which case it has no results
+		for _, result := range results[batchIndex[i]] {
+			kustomized = append(kustomized, result)
+		}
+	}
+	return kustomized, nil
+}
 
-		memFS := filesys.MakeFsInMemory()
+// patchedObject is an object and the patches that target it
+type patchedObject struct {
+	object  *unstructured.Unstructured
+	patches []Patch
+}
 
-		// writes the resource to a file in the temp file system
-		b, err := yaml.Marshal(resource.Object)
-		if err != nil {
-			return nil, err
+// indexAnnotation tags each object in a batch so that patches can be targeted at
+// individual objects, and the results mapped back to the object they came from
+const indexAnnotation = "kommons.flanksource.com/kustomize-index"
+
+// kustomizeBatch applies the patches of each object, returning the results for each object by index.
+// Objects are kustomized together in as few krusty runs as possible, objects that share
+// a kind, name and namespace are split across runs as krusty requires unique resource ids
+func kustomizeBatch(batch []patchedObject) ([][]*unstructured.Unstructured, error) {
+	results := make([][]*unstructured.Unstructured, len(batch))
+	var runs [][]int
+	seen := make(map[string]int)
+	for i, item := range batch {
+		// krusty treats the default namespace the same as no namespace
+		namespace := item.object.GetNamespace()
+		if namespace == "default" {
+			namespace = ""
 		}
-		name := "resource.yaml"
-		memFS.WriteFile(filepath.Join(fakeDir, name), b) // nolint: errcheck
-
-		// writes strategic merge patches to files in the temp file system
-		// km.kustomizationFile.PatchesStrategicMerge = []types.PatchStrategicMerge{}
-		// for i, p := range strategicMerge {
-		// 	b, err := yaml.Marshal(p)
-		// 	if err != nil {
-		// 		return nil, err
-		// 	}
-		// 	name := fmt.Sprintf("patch-%d.yaml", i)
-		// 	memFS.WriteFile(filepath.Join(fakeDir, name), b) // nolint: errcheck
-
-		// 	km.kustomizationFile.PatchesStrategicMerge = append(km.kustomizationFile.PatchesStrategicMerge, types.PatchStrategicMerge(name))
-		// }
-
-		// // writes json6902 patches to files in the temp file system
-		// km.kustomizationFile.PatchesJson6902 = []types.Patch
-		// for i, p := range json6902 {
-		// 	name := fmt.Sprintf("patchjson-%d.yaml", i)
-		// 	memFS.WriteFile(filepath.Join(fakeDir, name), []byte(p.Patch)) // nolint: errcheck
-
-		// 	km.kustomizationFile.PatchesJson6902 = append(km.kustomizationFile.PatchesJson6902, types.Patch{Target: p.Target, Path: name})
-		// }
-
-		// writes the kustomization file to the temp file system
-		km.kustomizationFile = &types.Kustomization{Resources: []string{name}}
-		kbytes, err := yaml.Marshal(km.kustomizationFile)
-		if err != nil {
+		id := item.object.GroupVersionKind().String() + "/" + namespace + "/" + item.object.GetName()
+		run := seen[id]
+		seen[id]++
+		if run == len(runs) {
+			runs = append(runs, nil)
+		}
+		runs[run] = append(runs[run], i)
+	}
+	for _, run := range runs {
+		if err := kustomizeRun(batch, run, results); err != nil {
 			return nil, err
 		}
-		memFS.WriteFile(filepath.Join(fakeDir, "kustomization.yaml"), kbytes) // nolint: errcheck
+	}
+	return results, nil
+}
+
+// kustomizeRun kustomizes the objects at indexes in a single krusty run, storing their results
+func kustomizeRun(batch []patchedObject, indexes []int, results [][]*unstructured.Unstructured) error {
+	// create an in memory fs to use for the kustomization
+	fakeDir := "/"
+	// for Windows we need this to be a drive because kustomize uses filepath.Abs()
+	// which will add a drive letter if there is none. which drive letter is
+	// unimportant as the path is on the fake filesystem anyhow
+	if osruntime.GOOS == "windows" {
+		fakeDir = `C:\`
+	}
+
+	memFS := filesys.MakeFsInMemory()
 
-		kresult, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(memFS, fakeDir)
+	// writes the resources to a file in the temp file system, and collect
+	// the indexes of the objects targeted by each patch
+	var resources bytes.Buffer
+	var patches []Patch
+	targets := make(map[string][]string)
+	for _, i := range indexes {
+		resource := batch[i].object.DeepCopy()
+		setAnnotation(resource, indexAnnotation, strconv.Itoa(i))
+		b, err := yaml.Marshal(resource.Object)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		for _, r := range kresult.Resources() {
-			y, _ := r.AsYAML()
-			objects, err := GetUnstructuredObjects(y)
-			if err != nil {
-				return nil, err
+		resources.WriteString("---\n")
+		resources.Write(b)
+		for _, p := range batch[i].patches {
+			key := p.File + "\x00" + p.Patch
+			if _, ok := targets[key]; !ok {
+				patches = append(patches, p)
 			}
-			kustomized = append(kustomized, objects...)
+			targets[key] = append(targets[key], strconv.Itoa(i))
 		}
 	}
-	return kustomized, nil
-}
+	name := "resources.yaml"
+	memFS.WriteFile(filepath.Join(fakeDir, name), resources.Bytes()) // nolint: errcheck
 
-func GetUnstructuredObjects(data []byte) ([]runtime.Object, error) {
-	utfData, err := BytesToUtf8Lf(data)
+	// the patches have already been matched, so target the objects exactly as the
+	// namespace used for matching may differ from the resource's own namespace
+	kustomization := &types.Kustomization{Resources: []string{name}}
+	for _, p := range patches {
+		kustomization.Patches = append(kustomization.Patches, types.Patch{
+			Patch: p.Patch,
+			Target: &types.Selector{
+				AnnotationSelector: fmt.Sprintf("%s in (%s)", indexAnnotation, strings.Join(targets[p.File+"\x00"+p.Patch], ",")),
+			},
+		})
+	}
+
+	// writes the kustomization file to the temp file system
+	kbytes, err := yaml.Marshal(kustomization)
 	if err != nil {
-		return nil, fmt.Errorf("error converting to UTF %v", err)
+		return err
 	}
-	var items []runtime.Object
-	re := regexp.MustCompile(`(?m)^---\n`)
-	for _, chunk := range re.Split(utfData, -1) {
-		if strings.TrimSpace(chunk) == "" {
-			continue
-		}
-		decoder := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader([]byte(chunk)), 1024)
-		var resource *unstructured.Unstructured
+	memFS.WriteFile(filepath.Join(fakeDir, "kustomization.yaml"), kbytes) // nolint: errcheck
 
-		if err := decoder.Decode(&resource); err != nil {
-			return nil, fmt.Errorf("error decoding %s: %s", chunk, err)
+	kresult, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(memFS, fakeDir)
+	if err != nil {
+		return err
+	}
+	for _, r := range kresult.Resources() {
+		y, _ := r.AsYAML()
+		objects, err := GetUnstructuredObjects(y)
+		if err != nil {
+			return err
 		}
-		if resource != nil {
-			items = append(items, resource)
+		for _, obj := range objects {
+			resource := obj.(*unstructured.Unstructured)
+			annotations := resource.GetAnnotations()
+			i, err := strconv.Atoi(annotations[indexAnnotation])
+			if err != nil || i < 0 || i >= len(results) {
+				return fmt.Errorf("cannot map kustomized %s %s back to its input, the %s annotation was modified by a patch", resource.GetKind(), resource.GetName(), indexAnnotation)
+			}
+			delete(annotations, indexAnnotation)
+			resource.SetAnnotations(annotations)
+			results[i] = append(results[i], resource)
 		}
 	}
+	return nil
+}
 
-	return items, nil
+// GetUnstructuredObjects decodes the objects in a stream of YAML or JSON documents
+func GetUnstructuredObjects(data []byte) ([]runtime.Object, error) {
+	items, err := NewDecoder(bytes.NewReader(data), "").DecodeAll()
+	if err != nil {
+		return nil, err
+	}
+	var objects []runtime.Object
+	for _, item := range items {
+		objects = append(objects, item)
+	}
+	return objects, nil
 }
 
+// BytesToUtf8Lf converts UTF-8 or UTF-16 content with CRLF or CR line endings to UTF-8 with LF line endings
 func BytesToUtf8Lf(file []byte) (string, error) {
-	decoded := utfutil.BytesReader(file, utfutil.UTF8)
 	buf := new(bytes.Buffer)
-	_, err := buf.ReadFrom(decoded)
+	_, err := buf.ReadFrom(newLfReader(utfutil.BytesReader(file, utfutil.UTF8)))
 	if err != nil {
 		logger.Errorf("error reading from buffer: %v", err)
 		return "", err
 	}
-	val := buf.Bytes()
-	// replace \r with \n -> solves for Mac but leaves \n\n for Windows
-	val = bytes.ReplaceAll(val, []byte{13}, []byte{10})
-	// replace \n\n with \n
-	val = bytes.ReplaceAll(val, []byte{10, 10}, []byte{10})
-	return string(val), nil
+	return buf.String(), nil
 }
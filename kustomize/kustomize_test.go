@@ -2,9 +2,13 @@ package kustomize
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/TomOnTime/utfutil"
@@ -15,6 +19,9 @@ import (
 	"golang.org/x/text/transform"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/resid"
 )
 
 type UTFWriteCloser interface {
@@ -328,3 +335,339 @@ func TestGetUnstructuredObjects(t *testing.T) {
 		})
 	}
 }
+
+const deployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: default
+  labels:
+    app: web
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+        - name: web
+          image: nginx:1.19
+`
+
+const configMap = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: default
+data:
+  key: value
+`
+
+func newTestManager(t *testing.T, patches ...string) *Manager {
+	km := &Manager{FileSystem: filesys.MakeFsInMemory()}
+	for i, patch := range patches {
+		if err := km.AddPatch(fmt.Sprintf("%d-patch.yaml", i+1), []byte(patch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return km
+}
+
+func TestKustomizePatchTargeting(t *testing.T) {
+	km := newTestManager(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+`, `
+target:
+  kind: Deployment
+  labelSelector: app=web
+patch: |-
+  - op: replace
+    path: /spec/template/spec/containers/0/image
+    value: nginx:1.21
+`, `
+target:
+  kind: Deployment
+  name: other
+patch: |-
+  - op: replace
+    path: /spec/replicas
+    value: 10
+`)
+
+	objects, err := km.KustomizeRaw("default", []byte(deployment+"\n---\n"+configMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objects))
+	}
+
+	web := objects[0].(*unstructured.Unstructured)
+	replicas, _, _ := unstructured.NestedInt64(web.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+	containers, _, _ := unstructured.NestedSlice(web.Object, "spec", "template", "spec", "containers")
+	assert.Equal(t, "nginx:1.21", containers[0].(map[string]interface{})["image"])
+	assert.Equal(t, "true", web.GetAnnotations()["kustomize/patched"])
+
+	settings := objects[1].(*unstructured.Unstructured)
+	assert.Equal(t, "settings", settings.GetName())
+	_, patched := settings.GetAnnotations()["kustomize/patched"]
+	assert.False(t, patched, "resources without matching patches should not be annotated")
+}
+
+func TestPatchMatches(t *testing.T) {
+	km := newTestManager(t, `
+target:
+  group: apps
+  version: v1
+  kind: Deployment
+  name: web|api
+  namespace: default
+patch: |-
+  - op: remove
+    path: /spec/replicas
+`)
+	patches, err := km.GetPatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(patches))
+	assert.True(t, patches[0].JSON6902)
+
+	objects, _ := GetUnstructuredObjects([]byte(deployment))
+	web := objects[0].(*unstructured.Unstructured)
+	ok, err := patches[0].Matches("default", web)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	web.SetNamespace("")
+	ok, _ = patches[0].Matches("kube-system", web)
+	assert.False(t, ok, "namespace should fall back to the default namespace")
+
+	web.SetName("web-2")
+	ok, _ = patches[0].Matches("default", web)
+	assert.False(t, ok, "name patterns should be anchored")
+}
+
+func TestPatchOrder(t *testing.T) {
+	km := newTestManager(t)
+	for _, name := range []string{"10-patch.yaml", "2-patch.yaml", "1-patch.yaml"} {
+		km.AddPatch(name, []byte(fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\n", name))) // nolint: errcheck
+	}
+	patches, err := km.GetPatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, p := range patches {
+		files = append(files, filepath.Base(p.File))
+	}
+	assert.Equal(t, []string{"1-patch.yaml", "2-patch.yaml", "10-patch.yaml"}, files)
+}
+
+func TestKustomizeBatchOrder(t *testing.T) {
+	km := newTestManager(t, `
+target:
+  kind: ConfigMap
+patch: |-
+  - op: add
+    path: /data/patched
+    value: "true"
+`)
+	var docs []string
+	for _, ns := range []string{"default", "", "default", "other"} {
+		docs = append(docs, fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: %q\ndata:\n  key: value\n", ns))
+	}
+	docs = append(docs[:2], append([]string{deployment}, docs[2:]...)...)
+
+	objects, err := km.KustomizeRaw("default", []byte(strings.Join(docs, "\n---\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var namespaces []string
+	for _, obj := range objects {
+		u := obj.(*unstructured.Unstructured)
+		if u.GetKind() != "ConfigMap" {
+			namespaces = append(namespaces, u.GetKind())
+			continue
+		}
+		namespaces = append(namespaces, u.GetNamespace())
+		data, _, _ := unstructured.NestedStringMap(u.Object, "data")
+		assert.Equal(t, "true", data["patched"])
+		_, ok := u.GetAnnotations()[indexAnnotation]
+		assert.False(t, ok, "the index annotation should be removed")
+	}
+	assert.Equal(t, []string{"default", "", "Deployment", "default", "other"}, namespaces)
+}
+
+func TestKustomizePatchError(t *testing.T) {
+	km := newTestManager(t, `
+target:
+  kind: ConfigMap
+patch: |-
+  - op: replace
+    path: /data/missing/key
+    value: "true"
+`)
+	_, err := km.KustomizeRaw("default", []byte(configMap))
+	assert.Error(t, err)
+}
+
+func BenchmarkKustomize(b *testing.B) {
+	var batch []patchedObject
+	for i := 0; i < 100; i++ {
+		objects, _ := GetUnstructuredObjects([]byte(strings.ReplaceAll(deployment, "name: web\n", fmt.Sprintf("name: web-%d\n", i))))
+		batch = append(batch, patchedObject{object: objects[0].(*unstructured.Unstructured), patches: []Patch{{
+			File:   "1-patch.yaml",
+			Patch:  "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  replicas: 3\n",
+			Target: types.Selector{ResId: resid.ResId{Gvk: resid.Gvk{Kind: "Deployment"}}},
+		}}})
+	}
+
+	b.Run("PerObject", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for i := range batch {
+				if _, err := kustomizeBatch(batch[i : i+1]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := kustomizeBatch(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestPatchSteps(t *testing.T) {
+	km := newTestManager(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+`, `
+target:
+  kind: ConfigMap
+patch: |-
+  - op: add
+    path: /data/patched
+    value: "true"
+`, `
+target:
+  kind: Deployment
+patch: |-
+  - op: replace
+    path: /spec/template/spec/containers/0/image
+    value: nginx:1.21
+`)
+	objects, _ := GetUnstructuredObjects([]byte(deployment))
+	web := objects[0].(*unstructured.Unstructured)
+
+	steps, err := km.PatchSteps("default", web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(steps))
+	}
+	assert.Equal(t, "1-patch.yaml", steps[0].Patch.File)
+	assert.Contains(t, steps[0].Diff(), "+++ 1-patch.yaml")
+	assert.Contains(t, steps[0].Diff(), "-  replicas: 1\n+  replicas: 3\n")
+	assert.Equal(t, "3-patch.yaml", steps[1].Patch.File)
+	assert.Equal(t, steps[0].After, steps[1].Before)
+	assert.Contains(t, steps[1].Diff(), "+      - image: nginx:1.21")
+	_, patched := web.GetAnnotations()["kustomize/patched"]
+	assert.False(t, patched, "PatchSteps should not modify the object")
+
+	km.AnnotatePatches = true
+	kustomized, err := km.Kustomize("default", web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1-patch.yaml,3-patch.yaml", kustomized[0].(*unstructured.Unstructured).GetAnnotations()[PatchesAnnotation])
+}
+
+func TestCheckPatches(t *testing.T) {
+	km := newTestManager(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+`, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: wbe
+spec:
+  replicas: 3
+`, `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+spec:
+  items: []
+`)
+	assert.NoError(t, km.CheckPatches(), "checks are disabled by default")
+
+	km.Strict = StrictError
+	widget := "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: widget\nspec:\n  items: [a]\n"
+	if _, err := km.KustomizeRaw("default", []byte(deployment+"\n---\n"+widget)); err != nil {
+		t.Fatal(err)
+	}
+	err := km.CheckPatches()
+	unmatched, ok := err.(*UnmatchedPatchesError)
+	if !ok {
+		t.Fatalf("expected an UnmatchedPatchesError, got %v", err)
+	}
+	assert.Equal(t, 1, len(unmatched.Patches))
+	assert.Equal(t, "2-patch.yaml", unmatched.Patches[0].File)
+	assert.Contains(t, err.Error(), "wbe")
+	assert.True(t, km.warned["3-patch.yaml/example.com/v1/Widget"], "expected a warning for a strategic merge patch on a kind without a schema")
+	assert.False(t, km.warned["1-patch.yaml/apps/v1/Deployment"])
+
+	if _, err := km.KustomizeRaw("default", []byte(widget)); err != nil {
+		t.Fatal(err)
+	}
+	unmatched, _ = km.CheckPatches().(*UnmatchedPatchesError)
+	assert.Equal(t, 2, len(unmatched.Patches), "matches should be reset after each check")
+
+	km.Strict = StrictWarn
+	assert.NoError(t, km.CheckPatches())
+}
+
+func TestCheckPatchesConcurrent(t *testing.T) {
+	km := newTestManager(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+`)
+	km.Strict = StrictError
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := km.KustomizeRaw("default", []byte(deployment)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, km.CheckPatches())
+}
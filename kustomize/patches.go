@@ -0,0 +1,234 @@
+package kustomize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	"sigs.k8s.io/yaml"
+)
+
+// Patch is a strategic merge or JSON6902 patch and the resources it targets
+type Patch struct {
+	// File is the name of the file in the Manager's FileSystem the patch was loaded from
+	File string
+	// Patch is the content of the patch
+	Patch string
+	// Target selects the resources the patch applies to
+	Target types.Selector
+	// JSON6902 is true for JSON6902 patches, and false for strategic merge patches
+	JSON6902 bool
+}
+
+// Matches returns true if the patch targets obj, a selector namespace also matches
+// objects without a namespace when it equals defaultNamespace
+func (p Patch) Matches(defaultNamespace string, obj *unstructured.Unstructured) (bool, error) {
+	regex, err := types.NewSelectorRegex(&p.Target)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid target in %s", p.File)
+	}
+	gvk := obj.GroupVersionKind()
+	if !regex.MatchGvk(resid.Gvk{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}) || !regex.MatchName(obj.GetName()) {
+		return false, nil
+	}
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	if !regex.MatchNamespace(namespace) {
+		return false, nil
+	}
+	if ok, err := matchesSelector(p.Target.LabelSelector, obj.GetLabels()); !ok || err != nil {
+		return false, errors.Wrapf(err, "invalid labelSelector in %s", p.File)
+	}
+	if ok, err := matchesSelector(p.Target.AnnotationSelector, obj.GetAnnotations()); !ok || err != nil {
+		return false, errors.Wrapf(err, "invalid annotationSelector in %s", p.File)
+	}
+	return true, nil
+}
+
+func matchesSelector(selector string, set map[string]string) (bool, error) {
+	if selector == "" {
+		return true, nil
+	}
+	s, err := labels.Parse(selector)
+	if err != nil {
+		return false, err
+	}
+	return s.Matches(labels.Set(set)), nil
+}
+
+// patchEntry is the krusty patches format, a patch with an explicit target
+type patchEntry struct {
+	Path   string          `json:"path,omitempty"`
+	Patch  string          `json:"patch,omitempty"`
+	Target *types.Selector `json:"target,omitempty"`
+}
+
+// loadPatches reads every patch file in the FileSystem, in the numeric order of their name prefix.
+// Each YAML document in a file is one of:
+//   - a strategic merge patch, targeting the resource with its kind, name and namespace
+//   - a patch entry with a target selector and an inline patch or a path to one, as used by krusty
+func (km *Manager) loadPatches() ([]Patch, error) {
+	if km.FileSystem == nil {
+		return nil, nil
+	}
+	var files []string
+	err := km.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return patchOrder(files[i]) < patchOrder(files[j])
+	})
+
+	referenced := map[string]bool{}
+	parsed := make(map[string][]Patch, len(files))
+	parseErrors := make(map[string]error)
+	for _, file := range files {
+		data, err := km.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed[file], parseErrors[file] = km.parsePatches(file, data, referenced)
+	}
+
+	var patches []Patch
+	for _, file := range files {
+		// files referenced by the path of a patch entry are not patches themselves
+		if referenced[filepath.Clean(file)] {
+			continue
+		}
+		if err := parseErrors[file]; err != nil {
+			return nil, errors.Wrapf(err, "failed to read patch %s", file)
+		}
+		patches = append(patches, parsed[file]...)
+	}
+	return patches, nil
+}
+
+func (km *Manager) parsePatches(file string, data []byte, referenced map[string]bool) ([]Patch, error) {
+	var patches []Patch
+	name := strings.TrimPrefix(file, "/")
+	decoder := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(data), 1024)
+	for {
+		var doc interface{}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch value := doc.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			return nil, fmt.Errorf("JSON6902 patches require a target")
+		case map[string]interface{}:
+			if _, ok := value["kind"]; !ok {
+				patch, err := km.parsePatchEntry(file, name, value, referenced)
+				if err != nil {
+					return nil, err
+				}
+				patches = append(patches, patch)
+				continue
+			}
+			docJSON, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			smp, err := newStrategicMergeSliceFromBytes(docJSON)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range smp {
+				patch, err := yaml.Marshal(p.Object)
+				if err != nil {
+					return nil, err
+				}
+				gvk := p.GroupVersionKind()
+				patches = append(patches, Patch{
+					File:  name,
+					Patch: string(patch),
+					Target: types.Selector{
+						ResId: resid.ResId{
+							Gvk:       resid.Gvk{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+							Name:      regexp.QuoteMeta(p.GetName()),
+							Namespace: regexp.QuoteMeta(p.GetNamespace()),
+						},
+					},
+				})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected patch document of type %T", doc)
+		}
+	}
+	return patches, nil
+}
+
+func (km *Manager) parsePatchEntry(file, name string, doc map[string]interface{}, referenced map[string]bool) (Patch, error) {
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		return Patch{}, err
+	}
+	var entry patchEntry
+	if err := json.Unmarshal(docJSON, &entry); err != nil {
+		return Patch{}, err
+	}
+	if entry.Target == nil {
+		return Patch{}, fmt.Errorf("patch is missing a kind or target")
+	}
+	if entry.Patch == "" && entry.Path != "" {
+		path := filepath.Join(filepath.Dir(file), entry.Path)
+		content, err := km.ReadFile(path)
+		if err != nil {
+			return Patch{}, err
+		}
+		referenced[filepath.Clean(path)] = true
+		entry.Patch = string(content)
+	}
+	if entry.Patch == "" {
+		return Patch{}, fmt.Errorf("patch for target %s has no content", entry.Target)
+	}
+	var content interface{}
+	if err := yaml.Unmarshal([]byte(entry.Patch), &content); err != nil {
+		return Patch{}, errors.Wrapf(err, "invalid patch for target %s", entry.Target)
+	}
+	_, isJSON6902 := content.([]interface{})
+	return Patch{
+		File:     name,
+		Patch:    entry.Patch,
+		Target:   *entry.Target,
+		JSON6902: isJSON6902,
+	}, nil
+}
+
+// patchOrder returns the numeric prefix of patch files named like 1-patch.yaml
+func patchOrder(file string) int {
+	prefix := regexp.MustCompile(`^\d+`).FindString(filepath.Base(file))
+	if prefix == "" {
+		return 0
+	}
+	order, _ := strconv.Atoi(prefix)
+	return order
+}
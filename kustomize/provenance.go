@@ -0,0 +1,84 @@
+package kustomize
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// PatchesAnnotation lists the files of the patches applied to an object, it is
+// only added when Manager.AnnotatePatches is set
+const PatchesAnnotation = "kustomize/patches"
+
+// PatchStep is the effect of applying a single patch to an object
+type PatchStep struct {
+	Patch  Patch
+	Before *unstructured.Unstructured
+	// After is nil if the patch deleted the object
+	After *unstructured.Unstructured
+}
+
+// Diff returns a unified diff of the object's YAML before and after the patch
+func (s PatchStep) Diff() string {
+	before, _ := toYaml(s.Before)
+	after, _ := toYaml(s.After)
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: "before",
+		ToFile:   s.Patch.File,
+		Context:  2,
+	})
+	return diff
+}
+
+func toYaml(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	data, err := yaml.Marshal(obj.Object)
+	return string(data), err
+}
+
+// PatchSteps applies the patches that target obj one at a time, returning the
+// object before and after each patch. obj is not modified
+func (km *Manager) PatchSteps(namespace string, obj *unstructured.Unstructured) ([]PatchStep, error) {
+	patches, err := km.patchesFor(namespace, obj)
+	if err != nil {
+		return nil, err
+	}
+	var steps []PatchStep
+	current := obj.DeepCopy()
+	for _, patch := range patches {
+		results, err := kustomizeBatch([]patchedObject{{current, []Patch{patch}}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to apply patch from %s", patch.File)
+		}
+		step := PatchStep{Patch: patch, Before: current}
+		if len(results[0]) > 0 {
+			step.After = results[0][0]
+		}
+		steps = append(steps, step)
+		if step.After == nil {
+			break
+		}
+		current = step.After
+	}
+	return steps, nil
+}
+
+// patchFiles returns the distinct files that patches were loaded from
+func patchFiles(patches []Patch) string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, patch := range patches {
+		if !seen[patch.File] {
+			seen[patch.File] = true
+			files = append(files, patch.File)
+		}
+	}
+	return strings.Join(files, ",")
+}
@@ -23,26 +23,12 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/yaml"
-	"sigs.k8s.io/kustomize/pkg/ifc"
 )
 
 // strategicMergeSlice is a slice of strategic merge patches.
 // Unstructured objects are used to represent strategic merge patches of any group/version/kind.
 type strategicMergeSlice []*unstructured.Unstructured
 
-// newStrategicMergeSliceFromFile returns a slice of strategic merge patches from a file
-func newStrategicMergeSliceFromFile(loader ifc.Loader, path string) (strategicMergeSlice, error) {
-	content, err := loader.Load(path)
-	if err != nil {
-		return nil, errors.Wrapf(err, "load from path %q failed", path)
-	}
-	res, err := newStrategicMergeSliceFromBytes(content)
-	if err != nil {
-		return nil, errors.Wrapf(err, "convert %q to Unstructured failed", path)
-	}
-	return res, nil
-}
-
 // newStrategicMergeSliceFromBytes returns a strategic merge patches contained in a []byte.
 // This functions handles all the nuances of Kubernetes yaml (e.g. many yaml
 // documents in one file, List of objects)
@@ -103,19 +89,6 @@ func newStrategicMergeSliceFromBytes(in []byte) (strategicMergeSlice, error) {
 	return result, nil
 }
 
-// filterByResource returns all the strategic merge patches in the strategicMergeSlice corresponding to a given resource
-func (s *strategicMergeSlice) filterByResource(namespace string, r *unstructured.Unstructured) strategicMergeSlice {
-	var result strategicMergeSlice
-	for _, p := range *s {
-		if p.GroupVersionKind() == r.GroupVersionKind() &&
-			(p.GetNamespace() == r.GetNamespace() || p.GetNamespace() == namespace) &&
-			p.GetName() == r.GetName() {
-			result = append(result, p)
-		}
-	}
-	return result
-}
-
 // validate validates that u has kind and name
 // except for kind `List`, which doesn't require a name
 func validate(u unstructured.Unstructured) error {
@@ -0,0 +1,120 @@
+package kustomize
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flanksource/commons/logger"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// StrictMode controls how Manager.CheckPatches handles patches that did not match any object
+type StrictMode int
+
+const (
+	// StrictOff does not check patches
+	StrictOff StrictMode = iota
+	// StrictWarn logs a warning for each patch that did not match any object
+	StrictWarn
+	// StrictError returns an error listing the patches that did not match any object
+	StrictError
+)
+
+// UnmatchedPatchesError is returned by CheckPatches in StrictError mode
+type UnmatchedPatchesError struct {
+	Patches []Patch
+}
+
+func (e *UnmatchedPatchesError) Error() string {
+	var targets []string
+	for _, p := range e.Patches {
+		targets = append(targets, fmt.Sprintf("%s (%s)", p.File, describeTarget(p)))
+	}
+	return fmt.Sprintf("%d patches did not match any object: %s", len(e.Patches), strings.Join(targets, ", "))
+}
+
+func describeTarget(p Patch) string {
+	target := p.Target.ResId.String()
+	if p.Target.LabelSelector != "" {
+		target += " labelSelector=" + p.Target.LabelSelector
+	}
+	if p.Target.AnnotationSelector != "" {
+		target += " annotationSelector=" + p.Target.AnnotationSelector
+	}
+	return target
+}
+
+// UnmatchedPatches returns the patches that have not matched any object passed to Kustomize
+// since the patches were loaded or last checked
+func (km *Manager) UnmatchedPatches() ([]Patch, error) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	return km.unmatchedPatches()
+}
+
+func (km *Manager) unmatchedPatches() ([]Patch, error) {
+	patches, err := km.getPatches()
+	if err != nil {
+		return nil, err
+	}
+	var unmatched []Patch
+	for i, patch := range patches {
+		if !km.matched[i] {
+			unmatched = append(unmatched, patch)
+		}
+	}
+	return unmatched, nil
+}
+
+// CheckPatches reports the patches that have not matched any object according to the Strict mode,
+// and then resets the tracking so that the next run is checked independently. Patches are shared
+// by every run, so it should be called once all the objects the patches target have been kustomized
+func (km *Manager) CheckPatches() error {
+	if km.Strict == StrictOff {
+		return nil
+	}
+	km.lock.Lock()
+	unmatched, err := km.unmatchedPatches()
+	km.matched = nil
+	km.lock.Unlock()
+	if err != nil || len(unmatched) == 0 {
+		return err
+	}
+	if km.Strict == StrictError {
+		return &UnmatchedPatchesError{Patches: unmatched}
+	}
+	for _, p := range unmatched {
+		logger.Warnf("kustomize patch %s did not match any object: %s", p.File, describeTarget(p))
+	}
+	return nil
+}
+
+// recordMatch marks the patch at index i as having matched obj, and warns once per patch and kind
+// when a strategic merge patch targets a kind that kustomize has no schema for, km.lock must be held
+func (km *Manager) recordMatch(i int, obj *unstructured.Unstructured) {
+	if km.matched == nil {
+		km.matched = make(map[int]bool)
+	}
+	km.matched[i] = true
+
+	patch := km.patches[i]
+	if km.Strict == StrictOff || patch.JSON6902 {
+		return
+	}
+	typeMeta := kyaml.TypeMeta{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind()}
+	if openapi.SchemaForResourceType(typeMeta) != nil {
+		return
+	}
+	key := patch.File + "/" + typeMeta.APIVersion + "/" + typeMeta.Kind
+	if km.warned == nil {
+		km.warned = make(map[string]bool)
+	}
+	if km.warned[key] {
+		return
+	}
+	km.warned[key] = true
+	logger.Warnf("strategic merge patch %s targets %s %s which has no patch strategy, it will be applied as a JSON merge patch and lists will be replaced rather than merged",
+		patch.File, typeMeta.APIVersion, typeMeta.Kind)
+}
@@ -17,26 +17,87 @@ limitations under the License.
 package proxy
 
 import (
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/httpstream"
 )
 
+// remoteErrorWait is how long a failed read waits for an error from the error stream
+const remoteErrorWait = time.Second
+
 // Conn is a Kubernetes API server proxied type of net/conn
 type Conn struct {
 	stream        httpstream.Stream
+	remote        *remoteError
+	release       func()
 	readDeadline  time.Time
 	writeDeadline time.Time
 }
 
-// Read from the connection
+// remoteError holds the message written by the API server to the error stream
+// paired with a data stream
+type remoteError struct {
+	done chan struct{}
+	err  error
+}
+
+// watchErrorStream reads the error stream until it is closed by the API server
+func watchErrorStream(errorStream httpstream.Stream, port string) *remoteError {
+	remote := &remoteError{done: make(chan struct{})}
+	go func() {
+		defer close(remote.done)
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			remote.err = fmt.Errorf("error reading from error stream for port %s: %v", port, err)
+		case len(message) > 0:
+			remote.err = fmt.Errorf("an error occurred forwarding port %s: %s", port, string(message))
+		}
+	}()
+	return remote
+}
+
+// Read from the connection, returning any error reported on the error stream
+// if the data stream fails. A clean EOF is returned without waiting for the error stream
 func (c Conn) Read(b []byte) (n int, err error) {
-	return c.stream.Read(b)
+	n, err = c.stream.Read(b)
+	if err == io.EOF && c.remote != nil {
+		select {
+		case <-c.remote.done:
+			if c.remote.err != nil {
+				return n, c.remote.err
+			}
+		default:
+		}
+	} else if err != nil && c.remote != nil {
+		select {
+		case <-c.remote.done:
+			if c.remote.err != nil {
+				return n, c.remote.err
+			}
+		case <-time.After(remoteErrorWait):
+		}
+	}
+	return n, err
 }
 
 // Close the underlying proxied connection
 func (c Conn) Close() error {
+	err := c.stream.Close()
+	if c.release != nil {
+		c.release()
+	}
+	return err
+}
+
+// CloseWrite closes the data stream for writing, so the remote reads EOF while
+// the connection can still be read from
+func (c Conn) CloseWrite() error {
 	return c.stream.Close()
 }
 
@@ -82,3 +143,20 @@ func NewConn(stream httpstream.Stream) Conn {
 		stream: stream,
 	}
 }
+
+// newPooledConn creates a Conn for a stream pair on a pooled connection, the
+// streams are released back to the pool when the Conn is closed
+func newPooledConn(pool *connectionPool, conn *pooledConnection, dataStream, errorStream httpstream.Stream) Conn {
+	var once sync.Once
+	return Conn{
+		stream: dataStream,
+		remote: watchErrorStream(errorStream, dataStream.Headers().Get(corev1.PortHeader)),
+		release: func() {
+			once.Do(func() {
+				dataStream.Reset()  // nolint: errcheck
+				errorStream.Reset() // nolint: errcheck
+				pool.release(conn, dataStream, errorStream)
+			})
+		},
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeStream is a data or error stream backed by a reader
+type fakeStream struct {
+	io.Reader
+}
+
+func (s fakeStream) Write(p []byte) (int, error) { return len(p), nil }
+func (s fakeStream) Close() error                { return nil }
+func (s fakeStream) Reset() error                { return nil }
+func (s fakeStream) Headers() http.Header        { return http.Header{} }
+func (s fakeStream) Identifier() uint32          { return 0 }
+
+func TestConnReadEOF(t *testing.T) {
+	// the error stream is never closed, as if the API server had not finished with it
+	pending, _ := io.Pipe()
+	conn := Conn{
+		stream: fakeStream{bytes.NewBufferString("")},
+		remote: watchErrorStream(fakeStream{pending}, "8080"),
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= remoteErrorWait {
+		t.Errorf("a clean EOF should not wait for the error stream, waited %v", elapsed)
+	}
+
+	conn = Conn{
+		stream: fakeStream{bytes.NewBufferString("")},
+		remote: watchErrorStream(fakeStream{bytes.NewBufferString("connection refused")}, "8080"),
+	}
+	<-conn.remote.done
+	if _, err := conn.Read(make([]byte, 10)); err == nil || err == io.EOF {
+		t.Errorf("expected the error stream's error, got %v", err)
+	}
+}
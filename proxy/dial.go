@@ -18,32 +18,46 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
 )
 
-const defaultTimeout = 10 * time.Second
+const (
+	defaultTimeout   = 10 * time.Second
+	defaultKeepAlive = 5 * time.Second
+)
 
 // Dialer creates connections using Kubernetes API Server port-forwarding
 type Dialer struct {
 	proxy          Proxy
-	clientset      *kubernetes.Clientset
+	clientset      kubernetes.Interface
 	proxyTransport http.RoundTripper
 	upgrader       spdy.Upgrader
+	config         *rest.Config
+	transport      Transport
 	timeout        time.Duration
+	idleTimeout    time.Duration
+	pool           *connectionPool
+
+	lock   sync.Mutex
+	target *target
 }
 
 // NewDialer creates a new dialer for a given API server scope
-func NewDialer(p Proxy, clientset *kubernetes.Clientset, config *rest.Config, options ...func(*Dialer) error) (*Dialer, error) {
+func NewDialer(p Proxy, clientset kubernetes.Interface, config *rest.Config, options ...func(*Dialer) error) (*Dialer, error) {
 	if p.Port == 0 {
 		return nil, errors.New("port required")
 	}
@@ -62,61 +76,196 @@ func NewDialer(p Proxy, clientset *kubernetes.Clientset, config *rest.Config, op
 	if dialer.timeout == 0 {
 		dialer.timeout = defaultTimeout
 	}
+	if dialer.idleTimeout == 0 {
+		dialer.idleTimeout = defaultIdleTimeout
+	}
 
-	proxyTransport, upgrader, err := spdy.RoundTripperFor(config)
+	pingPeriod := defaultKeepAlive
+	if p.KeepAlive != nil {
+		pingPeriod = *p.KeepAlive
+	}
+	proxyTransport, upgrader, err := roundTripperFor(config, pingPeriod)
 	if err != nil {
 		return nil, err
 	}
 	dialer.proxyTransport = proxyTransport
 	dialer.upgrader = upgrader
 	dialer.clientset = clientset
+	dialer.config = config
+	dialer.pool = newConnectionPool(dialer.idleTimeout)
 	return dialer, nil
 }
 
+// Close closes all upgraded connections held by the dialer, connections
+// previously returned by DialContext are reset
+func (d *Dialer) Close() error {
+	return d.pool.Close()
+}
+
 // DialContextWithAddr is a GO grpc compliant dialer construct
 func (d *Dialer) DialContextWithAddr(ctx context.Context, addr string) (net.Conn, error) {
 	return d.DialContext(ctx, scheme, addr)
 }
 
-// DialContext creates proxied port-forwarded connections.
-// ctx is currently unused, but fulfils the type signature used by GRPC.
-func (d *Dialer) DialContext(_ context.Context, network string, addr string) (net.Conn, error) {
-	req := d.clientset.CoreV1().RESTClient().
-		Post().
-		Resource(d.proxy.Kind).
-		Namespace(d.proxy.Namespace).
-		Name(d.proxy.ResourceName).
-		SubResource("portforward")
+// DialContext creates proxied port-forwarded connections, fulfilling the type signature used by GRPC.
+// Dialing is aborted when ctx is cancelled or the dial timeout is exceeded.
+// Services, deployments and statefulsets are resolved to a ready backing pod, which is
+// re-resolved if it can no longer be reached. When TLSConfig is set the connection
+// is wrapped in TLS, using the host in addr as the server name if none is configured.
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
 
-	dialer := spdy.NewDialer(d.upgrader, &http.Client{Transport: d.proxyTransport}, "POST", req.URL())
+	conn, err := d.dialTarget(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.TLSConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, d.tlsConfigFor(addr))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "tls handshake failed")
+	}
+	return tlsConn, nil
+}
 
-	p, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+func (d *Dialer) dialTarget(ctx context.Context) (net.Conn, error) {
+	t, err := d.getTarget(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "error upgrading connection for: "+req.URL().String())
+		return nil, err
 	}
-	headers := http.Header{}
-	headers.Set(corev1.StreamType, corev1.StreamTypeError)
-	headers.Set(corev1.PortHeader, fmt.Sprintf("%d", d.proxy.Port))
-	// We only create a single stream over the connection
-	headers.Set(corev1.PortForwardRequestIDHeader, "0")
-	errorStream, err := p.CreateStream(headers)
+	conn, err := d.dial(ctx, t)
+	if err == nil || ctx.Err() != nil || normalizeKind(d.proxy.Kind) == "pods" {
+		return conn, err
+	}
+
+	// the backing pod may have been replaced, so resolve the target again
+	d.resetTarget(t)
+	next, resolveErr := d.getTarget(ctx)
+	if resolveErr != nil || next.pod == t.pod {
+		return nil, err
+	}
+	return d.dial(ctx, next)
+}
+
+// tlsConfigFor returns the proxy's TLS config, defaulting the server name
+// to the host in addr or the resource name
+func (d *Dialer) tlsConfigFor(addr string) *tls.Config {
+	config := d.proxy.TLSConfig.Clone()
+	if config.ServerName != "" {
+		return config
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		config.ServerName = host
+	} else {
+		config.ServerName = d.proxy.ResourceName
+	}
+	return config
+}
+
+// getTarget returns the cached target pod, resolving it if necessary
+func (d *Dialer) getTarget(ctx context.Context) (*target, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.target != nil {
+		return d.target, nil
+	}
+	t, err := resolveTarget(ctx, d.clientset, d.proxy)
 	if err != nil {
 		return nil, err
 	}
+	d.target = t
+	return t, nil
+}
+
+// resetTarget clears the cached target if it is still t
+func (d *Dialer) resetTarget(t *target) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.target == t {
+		d.target = nil
+	}
+}
+
+// dial opens a stream pair to the target, reusing the upgraded connection to its pod if
+// one is open. A pooled connection that fails to create streams is discarded and redialed once
+func (d *Dialer) dial(ctx context.Context, t *target) (net.Conn, error) {
+	reused := true
+	conn, err := d.openStreams(ctx, t, &reused)
+	if err == nil || !reused || ctx.Err() != nil {
+		return conn, err
+	}
+	return d.openStreams(ctx, t, &reused)
+}
 
+// openStreams creates an error and data stream pair on the pooled connection to the target,
+// reused is set to false if a new connection had to be upgraded
+func (d *Dialer) openStreams(ctx context.Context, t *target, reused *bool) (net.Conn, error) {
+	pooled, requestID, err := d.pool.acquire(t.pod, func() (httpstream.Connection, error) {
+		*reused = false
+		return d.upgrade(ctx, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, fmt.Sprintf("%d", t.port))
+	headers.Set(corev1.PortForwardRequestIDHeader, fmt.Sprintf("%d", requestID))
+	errorStream, err := pooled.CreateStream(headers)
+	if err != nil {
+		d.pool.release(pooled)
+		d.pool.discard(pooled)
+		return nil, errors.Wrap(err, "error creating error stream")
+	}
+	// we're not writing to the error stream, the API server writes to it if forwarding fails
 	if err := errorStream.Close(); err != nil {
+		d.pool.release(pooled, errorStream)
 		return nil, err
 	}
 
 	headers.Set(corev1.StreamType, corev1.StreamTypeData)
-	dataStream, err := p.CreateStream(headers)
+	dataStream, err := pooled.CreateStream(headers)
 	if err != nil {
+		d.pool.release(pooled, errorStream)
+		d.pool.discard(pooled)
 		return nil, errors.Wrap(err, "error creating forwarding stream")
 	}
 
-	c := NewConn(dataStream)
+	return newPooledConn(d.pool, pooled, dataStream, errorStream), nil
+}
+
+// upgrade creates a new SPDY connection to the port-forward subresource of the target pod,
+// tunneled over WebSocket depending on the dialer's transport
+func (d *Dialer) upgrade(ctx context.Context, t *target) (httpstream.Connection, error) {
+	req := d.clientset.CoreV1().RESTClient().
+		Post().
+		Resource("pods").
+		Namespace(d.proxy.Namespace).
+		Name(t.pod).
+		SubResource("portforward")
 
-	return c, nil
+	if d.transport == TransportWebSocket || d.transport == TransportAuto {
+		conn, err := upgradeWebSocket(ctx, d.config, req.URL())
+		if err == nil || d.transport == TransportWebSocket || !ShouldFallback(err) {
+			if err != nil {
+				return nil, errors.Wrap(err, "error upgrading websocket connection for: "+req.URL().String())
+			}
+			return conn, nil
+		}
+	}
+
+	upgradeReq, err := http.NewRequestWithContext(ctx, "POST", req.URL().String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := spdy.Negotiate(d.upgrader, &http.Client{Transport: d.proxyTransport}, upgradeReq, portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "error upgrading connection for: "+req.URL().String())
+	}
+	return conn, nil
 }
 
 // DialTimeout sets the timeout
@@ -130,3 +279,83 @@ func (d *Dialer) setTimeout(duration time.Duration) error {
 	d.timeout = duration
 	return nil
 }
+
+// IdleTimeout sets how long an upgraded connection with no open streams is
+// kept for reuse before it is closed
+func IdleTimeout(duration time.Duration) func(*Dialer) error {
+	return func(d *Dialer) error {
+		d.idleTimeout = duration
+		return nil
+	}
+}
+
+// roundTripperFor is spdy.RoundTripperFor with a configurable ping period,
+// the pings keep otherwise idle port-forwarded connections open
+func roundTripperFor(config *rest.Config, pingPeriod time.Duration) (http.RoundTripper, spdy.Upgrader, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxier := http.ProxyFromEnvironment
+	if config.Proxy != nil {
+		proxier = config.Proxy
+	}
+	upgradeRoundTripper, err := spdystream.NewRoundTripperWithConfig(spdystream.RoundTripperConfig{
+		TLS:        tlsConfig,
+		Proxier:    proxier,
+		PingPeriod: pingPeriod,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapper, err := rest.HTTPWrappersForConfig(config, upgradeRoundTripper)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapper, upgradeRoundTripper, nil
+}
+
+// dialerCache creates and reuses a Dialer per target
+type dialerCache struct {
+	clientset kubernetes.Interface
+	config    *rest.Config
+	options   []func(*Dialer) error
+
+	lock    sync.Mutex
+	dialers map[string]*Dialer
+}
+
+func newDialerCache(clientset kubernetes.Interface, config *rest.Config, options []func(*Dialer) error) *dialerCache {
+	return &dialerCache{
+		clientset: clientset,
+		config:    config,
+		options:   options,
+		dialers:   make(map[string]*Dialer),
+	}
+}
+
+func (c *dialerCache) get(target Proxy) (*Dialer, error) {
+	key := fmt.Sprintf("%s/%s/%s:%d", normalizeKind(target.Kind), target.Namespace, target.ResourceName, target.Port)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if dialer, ok := c.dialers[key]; ok {
+		return dialer, nil
+	}
+	dialer, err := NewDialer(target, c.clientset, c.config, c.options...)
+	if err != nil {
+		return nil, err
+	}
+	c.dialers[key] = dialer
+	return dialer, nil
+}
+
+// Close closes all cached dialers
+func (c *dialerCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, dialer := range c.dialers {
+		dialer.Close() // nolint: errcheck
+		delete(c.dialers, key)
+	}
+	return nil
+}
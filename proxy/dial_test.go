@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSConfigFor(t *testing.T) {
+	d := &Dialer{proxy: Proxy{ResourceName: "web", TLSConfig: &tls.Config{}}}
+	if name := d.tlsConfigFor("web.default.svc:443").ServerName; name != "web.default.svc" {
+		t.Errorf("expected server name from addr, got %s", name)
+	}
+	if name := d.tlsConfigFor("").ServerName; name != "web" {
+		t.Errorf("expected server name from resource name without an addr, got %s", name)
+	}
+	if name := d.tlsConfigFor("proxy").ServerName; name != "web" {
+		t.Errorf("expected server name from resource name, got %s", name)
+	}
+	if d.proxy.TLSConfig.ServerName != "" {
+		t.Errorf("expected the proxy's TLS config to be left unchanged")
+	}
+
+	d.proxy.TLSConfig.ServerName = "example.com"
+	if name := d.tlsConfigFor("web.default.svc:443").ServerName; name != "example.com" {
+		t.Errorf("expected configured server name, got %s", name)
+	}
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ContextDialer is implemented by Dialer and net.Dialer
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// PortForwarder binds a local TCP port and forwards each accepted connection
+// through a Dialer
+type PortForwarder struct {
+	dialer   ContextDialer
+	listener net.Listener
+
+	lock   sync.Mutex
+	closed bool
+	conns  map[*connPair]struct{}
+	wg     sync.WaitGroup
+}
+
+// connPair is a local connection and the remote connection it is forwarded to
+type connPair struct {
+	local, remote net.Conn
+}
+
+func (p *connPair) Close() {
+	p.local.Close()
+	p.remote.Close()
+}
+
+// NewPortForwarder listens on address, e.g. "127.0.0.1:8080" or "localhost:0" to
+// pick a free port, connections are not accepted until Serve is called
+func NewPortForwarder(dialer ContextDialer, address string) (*PortForwarder, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", address)
+	}
+	return &PortForwarder{
+		dialer:   dialer,
+		listener: listener,
+		conns:    make(map[*connPair]struct{}),
+	}, nil
+}
+
+// Addr returns the bound local address, including the port chosen when listening on port 0
+func (f *PortForwarder) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// ActiveConnections returns the number of connections currently being forwarded
+func (f *PortForwarder) ActiveConnections() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.conns)
+}
+
+// Serve accepts and forwards connections until ctx is cancelled or Close is called,
+// it waits for active connections to be closed before returning
+func (f *PortForwarder) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		f.Close() // nolint: errcheck
+	}()
+	defer f.wg.Wait()
+	for {
+		local, err := f.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.forward(ctx, local)
+		}()
+	}
+}
+
+// Close stops accepting new connections and closes all active connections
+func (f *PortForwarder) Close() error {
+	err := f.listener.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	for pair := range f.conns {
+		pair.Close()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (f *PortForwarder) forward(ctx context.Context, local net.Conn) {
+	// the target is the dialer's resource, so no address is passed and a TLS server name defaults to it
+	remote, err := f.dialer.DialContext(ctx, scheme, "")
+	if err != nil {
+		local.Close()
+		return
+	}
+	pair := &connPair{local: local, remote: remote}
+	if !f.track(pair) {
+		return
+	}
+	defer f.untrack(pair)
+
+	join(ctx, local, remote)
+	pair.Close()
+}
+
+// closeWriter is implemented by connections that can be half-closed, e.g. *net.TCPConn and Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// join copies between a and b until both directions have finished or ctx is cancelled. When one
+// side sends EOF the write side of the other is closed, so that its response can still be read.
+// If the other side cannot be half-closed, or a copy fails, both connections are closed
+func join(ctx context.Context, a, b net.Conn) {
+	var wg sync.WaitGroup
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err == nil {
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		closeBoth()
+	}
+	wg.Add(2)
+	go pipe(b, a)
+	go pipe(a, b)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeBoth()
+		case <-stop:
+		}
+	}()
+	wg.Wait()
+}
+
+// track registers a connection pair, returning false and closing it if the forwarder is closed
+func (f *PortForwarder) track(pair *connPair) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		pair.Close()
+		return false
+	}
+	f.conns[pair] = struct{}{}
+	return true
+}
+
+func (f *PortForwarder) untrack(pair *connPair) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.conns, pair)
+}
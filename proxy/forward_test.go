@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// targetDialer dials a fixed address, standing in for port-forwarding
+type targetDialer struct {
+	addr string
+	// requested receives the address passed to each dial if set
+	requested chan string
+}
+
+func (d targetDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.requested != nil {
+		d.requested <- addr
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", d.addr)
+}
+
+func echoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) // nolint: errcheck
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestPortForwarder(t *testing.T) {
+	echo := echoServer(t)
+	requested := make(chan string, 1)
+	forwarder, err := NewPortForwarder(targetDialer{addr: echo.Addr().String(), requested: requested}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forwarder.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatalf("expected a port to be assigned")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- forwarder.Serve(ctx) }()
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("expected ping, got %q", line)
+	}
+	if addr := <-requested; addr != "" {
+		t.Errorf("expected no dial address so that TLS verifies the target rather than %s", addr)
+	}
+	if active := forwarder.ActiveConnections(); active != 1 {
+		t.Errorf("expected 1 active connection, got %d", active)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for forwarder to stop")
+	}
+	if active := forwarder.ActiveConnections(); active != 0 {
+		t.Errorf("expected 0 active connections, got %d", active)
+	}
+	if _, err := net.Dial("tcp", forwarder.Addr().String()); err == nil {
+		t.Errorf("expected listener to be closed")
+	}
+}
+
+// drainServer reads each connection until EOF and then replies with the number of bytes read
+func drainServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				time.Sleep(50 * time.Millisecond)
+				fmt.Fprintf(conn, "read %d bytes", len(data))
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// halfClose writes request, closes the write side and returns everything read afterwards
+func halfClose(t *testing.T, conn net.Conn, request string) string {
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(response)
+}
+
+func TestPortForwarderHalfClose(t *testing.T) {
+	server := drainServer(t)
+	forwarder, err := NewPortForwarder(targetDialer{addr: server.Addr().String()}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.Serve(ctx) // nolint: errcheck
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if response := halfClose(t, conn, "hello"); response != "read 5 bytes" {
+		t.Errorf("expected the response after a half-close, got %q", response)
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// RoundTripper is an http.RoundTripper for in-cluster services, requests to
+// http://svc.namespace:port/ are routed to port on the service svc in namespace
+type RoundTripper struct {
+	proxy     Proxy
+	clientset kubernetes.Interface
+	config    *rest.Config
+
+	// transport is used for port-forwarded requests
+	transport *http.Transport
+	// apiTransport is used for requests sent to the API server
+	apiTransport http.RoundTripper
+
+	dialers *dialerCache
+}
+
+// NewRoundTripper creates a RoundTripper, p provides the mode, the default namespace
+// for hosts without one and the TLS and keep alive settings used for each service.
+// options are applied to the Dialer created for each service in PortForwardMode
+func NewRoundTripper(p Proxy, clientset kubernetes.Interface, config *rest.Config, options ...func(*Dialer) error) (*RoundTripper, error) {
+	rt := &RoundTripper{
+		proxy:     p,
+		clientset: clientset,
+		config:    config,
+		dialers:   newDialerCache(clientset, config, options),
+	}
+	if p.Mode == ServiceProxyMode {
+		apiTransport, err := rest.TransportFor(config)
+		if err != nil {
+			return nil, err
+		}
+		rt.apiTransport = apiTransport
+		return rt, nil
+	}
+	rt.transport = &http.Transport{
+		DialContext:     rt.dialContext,
+		TLSClientConfig: p.TLSConfig,
+	}
+	return rt, nil
+}
+
+// ParseTarget maps a URL to the service it addresses, the host may be svc, svc.namespace,
+// svc.namespace.svc or svc.namespace.svc.cluster.local. Without a port the scheme default is used
+func ParseTarget(u *url.URL, defaultNamespace string) (Proxy, error) {
+	host := strings.TrimSuffix(u.Hostname(), ".")
+	host = strings.TrimSuffix(host, ".cluster.local")
+	host = strings.TrimSuffix(host, ".svc")
+	parts := strings.Split(host, ".")
+	if host == "" || len(parts) > 2 {
+		return Proxy{}, fmt.Errorf("cannot map host %s to a service", u.Host)
+	}
+	p := Proxy{
+		Kind:         "services",
+		ResourceName: parts[0],
+		Namespace:    defaultNamespace,
+	}
+	if len(parts) == 2 {
+		p.Namespace = parts[1]
+	}
+	switch {
+	case u.Port() != "":
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			return Proxy{}, errors.Wrapf(err, "invalid port in %s", u.Host)
+		}
+		p.Port = port
+	case u.Scheme == "https":
+		p.Port = 443
+	default:
+		p.Port = 80
+	}
+	return p, nil
+}
+
+// RoundTrip sends the request to the service addressed by its URL
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.proxy.Mode != ServiceProxyMode {
+		return rt.transport.RoundTrip(req)
+	}
+	target, err := ParseTarget(req.URL, rt.proxy.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	proxied := req.Clone(req.Context())
+	proxied.URL = rt.serviceProxyURL(req.URL, target)
+	proxied.Host = ""
+	proxied.RequestURI = ""
+	return rt.apiTransport.RoundTrip(proxied)
+}
+
+// serviceProxyURL returns the API server URL that proxies u to the target service
+func (rt *RoundTripper) serviceProxyURL(u *url.URL, target Proxy) *url.URL {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	proxyURL := rt.clientset.CoreV1().RESTClient().
+		Get().
+		Namespace(target.Namespace).
+		Resource("services").
+		Name(fmt.Sprintf("%s:%s:%d", scheme, target.ResourceName, target.Port)).
+		SubResource("proxy").
+		Suffix(u.Path).
+		URL()
+	// the request builder cleans the path, which drops any trailing slash
+	if strings.HasSuffix(u.Path, "/") && !strings.HasSuffix(proxyURL.Path, "/") {
+		proxyURL.Path += "/"
+	}
+	proxyURL.RawQuery = u.RawQuery
+	return proxyURL
+}
+
+// dialContext is used by the port-forward transport to connect to the service in addr
+func (rt *RoundTripper) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	target, err := ParseTarget(&url.URL{Host: net.JoinHostPort(host, port)}, rt.proxy.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	target.KeepAlive = rt.proxy.KeepAlive
+	dialer, err := rt.dialers.get(target)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Close closes idle connections and the port-forwarded connections held by the RoundTripper
+func (rt *RoundTripper) Close() error {
+	if rt.transport != nil {
+		rt.transport.CloseIdleConnections()
+	}
+	return rt.dialers.Close()
+}
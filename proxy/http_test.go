@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestParseTarget(t *testing.T) {
+	fixtures := []struct {
+		URL       string
+		Name      string
+		Namespace string
+		Port      int
+		Error     bool
+	}{
+		{URL: "http://web", Name: "web", Namespace: "default", Port: 80},
+		{URL: "https://web.monitoring", Name: "web", Namespace: "monitoring", Port: 443},
+		{URL: "http://web.monitoring:9090/metrics", Name: "web", Namespace: "monitoring", Port: 9090},
+		{URL: "http://web.monitoring.svc.cluster.local:8080", Name: "web", Namespace: "monitoring", Port: 8080},
+		{URL: "http://web.monitoring.svc:8080", Name: "web", Namespace: "monitoring", Port: 8080},
+		{URL: "http://example.com.au", Error: true},
+	}
+
+	for _, fixture := range fixtures {
+		_fixture := fixture
+		t.Run(fixture.URL, func(t *testing.T) {
+			u, _ := url.Parse(_fixture.URL)
+			p, err := ParseTarget(u, "default")
+			if _fixture.Error {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ResourceName != _fixture.Name || p.Namespace != _fixture.Namespace || p.Port != _fixture.Port {
+				t.Errorf("expected %s/%s:%d, got %s/%s:%d", _fixture.Namespace, _fixture.Name, _fixture.Port, p.Namespace, p.ResourceName, p.Port)
+			}
+		})
+	}
+}
+
+func TestServiceProxyRoundTripper(t *testing.T) {
+	var requested string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		io.WriteString(w, "ok") // nolint: errcheck
+	}))
+	defer apiServer.Close()
+
+	config := &rest.Config{Host: apiServer.URL}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewRoundTripper(Proxy{Mode: ServiceProxyMode, Namespace: "default"}, clientset, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+	resp, err := client.Get("http://prometheus.monitoring:9090/api/v1/query?query=up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Errorf("unexpected body %s", body)
+	}
+	expected := "/api/v1/namespaces/monitoring/services/http:prometheus:9090/proxy/api/v1/query?query=up"
+	if requested != expected {
+		t.Errorf("expected %s, got %s", expected, requested)
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+const defaultIdleTimeout = 60 * time.Second
+
+// pooledConnection is an upgraded port-forward connection to a single pod that is
+// shared by multiple stream pairs, each with its own request ID
+type pooledConnection struct {
+	httpstream.Connection
+	pod           string
+	nextRequestID int
+	streams       int
+	lastUsed      time.Time
+}
+
+// reserve returns the next request ID for a stream pair on c, the pool lock must be held
+func (c *pooledConnection) reserve() int {
+	requestID := c.nextRequestID
+	c.nextRequestID++
+	c.streams++
+	c.lastUsed = time.Now()
+	return requestID
+}
+
+// pendingDial is a connection being dialed, that concurrent acquires for the same pod wait for
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+func (c *pooledConnection) isClosed() bool {
+	select {
+	case <-c.CloseChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionPool reuses upgraded connections per pod and closes those that have
+// had no active streams for longer than idleTimeout
+type connectionPool struct {
+	lock        sync.Mutex
+	conns       map[string]*pooledConnection
+	pending     map[string]*pendingDial
+	closed      bool
+	idleTimeout time.Duration
+	stop        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newConnectionPool(idleTimeout time.Duration) *connectionPool {
+	pool := &connectionPool{
+		conns:       make(map[string]*pooledConnection),
+		pending:     make(map[string]*pendingDial),
+		idleTimeout: idleTimeout,
+		stop:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go pool.evictIdle()
+	}
+	return pool
+}
+
+// acquire returns a connection to pod, creating it with dial if there is no open
+// connection, and reserves the next request ID on it for a new stream pair.
+// dial is called without holding the pool lock so that a slow pod does not block other pods,
+// concurrent acquires for the same pod wait for a single dial
+func (p *connectionPool) acquire(pod string, dial func() (httpstream.Connection, error)) (*pooledConnection, int, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, 0, errors.New("connection pool is closed")
+		}
+		if conn, ok := p.conns[pod]; ok && !conn.isClosed() {
+			requestID := conn.reserve()
+			p.lock.Unlock()
+			return conn, requestID, nil
+		}
+		if pending, ok := p.pending[pod]; ok {
+			p.lock.Unlock()
+			<-pending.done
+			if pending.err != nil {
+				return nil, 0, pending.err
+			}
+			continue
+		}
+		pending := &pendingDial{done: make(chan struct{})}
+		p.pending[pod] = pending
+		p.lock.Unlock()
+
+		upgraded, err := dial()
+
+		p.lock.Lock()
+		delete(p.pending, pod)
+		if err == nil && p.closed {
+			upgraded.Close()
+			err = errors.New("connection pool is closed")
+		}
+		pending.err = err
+		close(pending.done)
+		if err != nil {
+			p.lock.Unlock()
+			return nil, 0, err
+		}
+		conn := &pooledConnection{Connection: upgraded, pod: pod}
+		p.conns[pod] = conn
+		requestID := conn.reserve()
+		p.lock.Unlock()
+		return conn, requestID, nil
+	}
+}
+
+// release marks a stream pair on conn as finished and removes its streams from the connection
+func (p *connectionPool) release(conn *pooledConnection, streams ...httpstream.Stream) {
+	conn.RemoveStreams(streams...)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	conn.streams--
+	conn.lastUsed = time.Now()
+}
+
+// discard closes conn and removes it from the pool, e.g. after a stream could not be created on it
+func (p *connectionPool) discard(conn *pooledConnection) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conns[conn.pod] == conn {
+		delete(p.conns, conn.pod)
+	}
+	conn.Close()
+}
+
+func (p *connectionPool) evictIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.lock.Lock()
+			for pod, conn := range p.conns {
+				if conn.isClosed() || (conn.streams <= 0 && now.Sub(conn.lastUsed) > p.idleTimeout) {
+					conn.Close()
+					delete(p.conns, pod)
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// Close closes all pooled connections and stops idle eviction
+func (p *connectionPool) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for pod, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, pod)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+type fakeConnection struct {
+	lock   sync.Mutex
+	closed chan bool
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{closed: make(chan bool)}
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	return nil, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool                     { return c.closed }
+func (c *fakeConnection) SetIdleTimeout(timeout time.Duration)       {}
+func (c *fakeConnection) RemoveStreams(streams ...httpstream.Stream) {}
+
+func TestConnectionPoolReuse(t *testing.T) {
+	pool := newConnectionPool(0)
+	defer pool.Close()
+	dials := 0
+	dial := func() (httpstream.Connection, error) {
+		dials++
+		return newFakeConnection(), nil
+	}
+
+	first, id, err := pool.acquire("web-0", dial)
+	if err != nil || id != 0 {
+		t.Fatalf("expected request id 0, got %d: %v", id, err)
+	}
+	second, id, _ := pool.acquire("web-0", dial)
+	if second != first || id != 1 {
+		t.Errorf("expected the connection to be reused with request id 1, got %d", id)
+	}
+	if dials != 1 {
+		t.Errorf("expected 1 dial, got %d", dials)
+	}
+
+	pool.discard(first)
+	third, id, _ := pool.acquire("web-0", dial)
+	if third == first || id != 0 || dials != 2 {
+		t.Errorf("expected a new connection after discard")
+	}
+	if _, _, err := pool.acquire("web-1", dial); err != nil || dials != 3 {
+		t.Errorf("expected a separate connection per pod")
+	}
+}
+
+func TestConnectionPoolEviction(t *testing.T) {
+	pool := newConnectionPool(20 * time.Millisecond)
+	defer pool.Close()
+	fake := newFakeConnection()
+	conn, _, _ := pool.acquire("web-0", func() (httpstream.Connection, error) { return fake, nil })
+
+	time.Sleep(60 * time.Millisecond)
+	if conn.isClosed() {
+		t.Fatalf("connections with active streams should not be evicted")
+	}
+	pool.release(conn)
+	time.Sleep(80 * time.Millisecond)
+	if !conn.isClosed() {
+		t.Errorf("expected idle connection to be evicted")
+	}
+}
+
+func TestConnectionPoolDialOutsideLock(t *testing.T) {
+	pool := newConnectionPool(0)
+	defer pool.Close()
+
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	dials := 0
+	slowDial := func() (httpstream.Connection, error) {
+		lock.Lock()
+		dials++
+		lock.Unlock()
+		<-unblock
+		return newFakeConnection(), nil
+	}
+
+	results := make(chan *pooledConnection, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, _, err := pool.acquire("slow-0", slowDial)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- conn
+		}()
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, _, err := pool.acquire("web-0", func() (httpstream.Connection, error) { return newFakeConnection(), nil })
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a slow dial blocked connections to other pods")
+	}
+
+	close(unblock)
+	first, second := <-results, <-results
+	if first != second {
+		t.Errorf("expected concurrent acquires to share a connection")
+	}
+	if dials != 1 {
+		t.Errorf("expected 1 dial for concurrent acquires, got %d", dials)
+	}
+}
@@ -24,7 +24,8 @@ import (
 // Proxy defines the API server port-forwarded proxy
 type Proxy struct {
 
-	// Kind is the kind of Kubernetes resource
+	// Kind is the kind of Kubernetes resource, one of pods, services,
+	// deployments or statefulsets
 	Kind string
 
 	// Namespace is the namespace in which the Kubernetes resource exists
@@ -39,6 +40,20 @@ type Proxy struct {
 	// the connection open
 	KeepAlive *time.Duration
 
-	// Port is the port to be forwarded from the relevant resource
+	// Port is the port to be forwarded from the relevant resource, for services
+	// this is the service port which is mapped to its (possibly named) targetPort
 	Port int
+
+	// Mode selects how a RoundTripper reaches HTTP endpoints, defaults to PortForwardMode
+	Mode Mode
 }
+
+// Mode is the mechanism used by a RoundTripper to reach in-cluster services
+type Mode string
+
+const (
+	// PortForwardMode tunnels requests through a Dialer
+	PortForwardMode Mode = "port-forward"
+	// ServiceProxyMode sends requests through the API server's services/proxy subresource
+	ServiceProxyMode Mode = "service-proxy"
+)
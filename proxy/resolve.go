@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// target is a pod and container port that port-forwarded connections are made to
+type target struct {
+	pod  string
+	port int
+}
+
+// normalizeKind maps the kinds, resource names and short names supported by Proxy
+// onto their plural resource name
+func normalizeKind(kind string) string {
+	switch strings.ToLower(kind) {
+	case "", "pod", "pods", "po":
+		return "pods"
+	case "service", "services", "svc":
+		return "services"
+	case "deployment", "deployments", "deploy":
+		return "deployments"
+	case "statefulset", "statefulsets", "sts":
+		return "statefulsets"
+	}
+	return strings.ToLower(kind)
+}
+
+// resolveTarget finds a ready pod backing the proxy's resource, and the container port
+// that the proxy's port maps to on that pod
+func resolveTarget(ctx context.Context, clientset kubernetes.Interface, p Proxy) (*target, error) {
+	switch normalizeKind(p.Kind) {
+	case "pods":
+		return &target{pod: p.ResourceName, port: p.Port}, nil
+	case "services":
+		svc, err := clientset.CoreV1().Services(p.Namespace).Get(ctx, p.ResourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get service %s/%s", p.Namespace, p.ResourceName)
+		}
+		var servicePort *corev1.ServicePort
+		for i, port := range svc.Spec.Ports {
+			if int(port.Port) == p.Port {
+				servicePort = &svc.Spec.Ports[i]
+				break
+			}
+		}
+		if servicePort == nil {
+			return nil, fmt.Errorf("service %s/%s does not expose port %d", p.Namespace, p.ResourceName, p.Port)
+		}
+		if len(svc.Spec.Selector) == 0 {
+			return nil, fmt.Errorf("service %s/%s has no selector", p.Namespace, p.ResourceName)
+		}
+		pod, err := findReadyPod(ctx, clientset, p.Namespace, labels.SelectorFromSet(svc.Spec.Selector))
+		if err != nil {
+			return nil, err
+		}
+		port, err := containerPort(pod, servicePort.TargetPort, servicePort.Port)
+		if err != nil {
+			return nil, err
+		}
+		return &target{pod: pod.Name, port: port}, nil
+	case "deployments":
+		deployment, err := clientset.AppsV1().Deployments(p.Namespace).Get(ctx, p.ResourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get deployment %s/%s", p.Namespace, p.ResourceName)
+		}
+		return resolveSelector(ctx, clientset, p, deployment.Spec.Selector)
+	case "statefulsets":
+		sts, err := clientset.AppsV1().StatefulSets(p.Namespace).Get(ctx, p.ResourceName, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get statefulset %s/%s", p.Namespace, p.ResourceName)
+		}
+		return resolveSelector(ctx, clientset, p, sts.Spec.Selector)
+	}
+	return nil, fmt.Errorf("unsupported proxy kind: %s", p.Kind)
+}
+
+func resolveSelector(ctx context.Context, clientset kubernetes.Interface, p Proxy, labelSelector *metav1.LabelSelector) (*target, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector for %s/%s", p.Namespace, p.ResourceName)
+	}
+	pod, err := findReadyPod(ctx, clientset, p.Namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	return &target{pod: pod.Name, port: p.Port}, nil
+}
+
+// findReadyPod returns the first running and ready pod matching selector
+func findReadyPod(ctx context.Context, clientset kubernetes.Interface, namespace string, selector labels.Selector) (*corev1.Pod, error) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list pods matching %s", selector)
+	}
+	for i, pod := range pods.Items {
+		if isPodReady(pod) {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no ready pods found in %s matching %s", namespace, selector)
+}
+
+func isPodReady(pod corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// containerPort resolves a service targetPort against the ports declared by pod,
+// an unset targetPort defaults to the service port
+func containerPort(pod *corev1.Pod, targetPort intstr.IntOrString, servicePort int32) (int, error) {
+	if targetPort.Type == intstr.Int {
+		if targetPort.IntVal == 0 {
+			return int(servicePort), nil
+		}
+		return int(targetPort.IntVal), nil
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == targetPort.StrVal {
+				return int(port.ContainerPort), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("pod %s/%s has no port named %s", pod.Namespace, pod.Name, targetPort.StrVal)
+}
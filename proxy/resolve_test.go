@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(name string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "web",
+				Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			}},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		newPod("web-0", false),
+		newPod("web-1", true),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "web"},
+				Ports: []corev1.ServicePort{
+					{Port: 80, TargetPort: intstr.FromString("http")},
+					{Port: 9090, TargetPort: intstr.FromInt(9091)},
+				},
+			},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			},
+		},
+	)
+
+	fixtures := []struct {
+		Name  string
+		Proxy Proxy
+		Pod   string
+		Port  int
+		Error bool
+	}{
+		{Name: "pod", Proxy: Proxy{Kind: "pods", ResourceName: "web-0", Port: 8080}, Pod: "web-0", Port: 8080},
+		{Name: "service named port", Proxy: Proxy{Kind: "svc", ResourceName: "web", Port: 80}, Pod: "web-1", Port: 8080},
+		{Name: "service numeric port", Proxy: Proxy{Kind: "Service", ResourceName: "web", Port: 9090}, Pod: "web-1", Port: 9091},
+		{Name: "service missing port", Proxy: Proxy{Kind: "services", ResourceName: "web", Port: 443}, Error: true},
+		{Name: "deployment", Proxy: Proxy{Kind: "deployments", ResourceName: "web", Port: 8080}, Pod: "web-1", Port: 8080},
+		{Name: "missing statefulset", Proxy: Proxy{Kind: "sts", ResourceName: "web", Port: 8080}, Error: true},
+	}
+
+	for _, fixture := range fixtures {
+		_fixture := fixture
+		t.Run(fixture.Name, func(t *testing.T) {
+			_fixture.Proxy.Namespace = "default"
+			target, err := resolveTarget(context.Background(), clientset, _fixture.Proxy)
+			if _fixture.Error {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.pod != _fixture.Pod || target.port != _fixture.Port {
+				t.Errorf("expected %s:%d, got %s:%d", _fixture.Pod, _fixture.Port, target.pod, target.port)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	socksVersion = 0x05
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// SOCKS5Server is a SOCKS5 proxy that exposes the cluster network, each CONNECT request
+// to a cluster DNS name or pod IP is resolved via the API and tunneled through port-forwarding.
+// Only the CONNECT command without authentication is supported
+type SOCKS5Server struct {
+	// DefaultNamespace is used for service names without a namespace
+	DefaultNamespace string
+
+	// Dial connects to a resolved target, it defaults to port-forwarding through a Dialer
+	Dial func(ctx context.Context, target Proxy) (net.Conn, error)
+
+	clientset kubernetes.Interface
+	dialers   *dialerCache
+	wg        sync.WaitGroup
+}
+
+// NewSOCKS5Server creates a SOCKS5Server, options are applied to the Dialer created for each target
+func NewSOCKS5Server(clientset kubernetes.Interface, config *rest.Config, options ...func(*Dialer) error) *SOCKS5Server {
+	s := &SOCKS5Server{
+		DefaultNamespace: "default",
+		clientset:        clientset,
+		dialers:          newDialerCache(clientset, config, options),
+	}
+	s.Dial = s.dialTarget
+	return s
+}
+
+func (s *SOCKS5Server) dialTarget(ctx context.Context, target Proxy) (net.Conn, error) {
+	dialer, err := s.dialers.get(target)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, scheme, net.JoinHostPort(target.ResourceName, strconv.Itoa(target.Port)))
+}
+
+// Serve accepts SOCKS5 connections on listener until ctx is cancelled, it closes
+// the listener and waits for active connections to finish before returning
+func (s *SOCKS5Server) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	defer s.wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.ServeConn(ctx, conn) // nolint: errcheck
+		}()
+	}
+}
+
+// Close closes the port-forwarded connections held by the server
+func (s *SOCKS5Server) Close() error {
+	return s.dialers.Close()
+}
+
+// ServeConn handles a single SOCKS5 client connection, closing it once finished
+func (s *SOCKS5Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	if err := socksHandshake(conn); err != nil {
+		return err
+	}
+	host, port, err := readSocksRequest(conn)
+	if err != nil {
+		return err
+	}
+
+	target, err := s.Resolve(ctx, host, port)
+	if err != nil {
+		writeSocksReply(conn, socksHostUnreachable) // nolint: errcheck
+		return err
+	}
+	remote, err := s.Dial(ctx, target)
+	if err != nil {
+		writeSocksReply(conn, socksConnectionRefused) // nolint: errcheck
+		return errors.Wrapf(err, "failed to connect to %s", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	defer remote.Close()
+	if err := writeSocksReply(conn, socksSucceeded); err != nil {
+		return err
+	}
+
+	join(ctx, conn, remote)
+	return nil
+}
+
+// Resolve maps a host requested by a SOCKS client to a port-forwarding target:
+//
+//	svc, svc.ns, svc.ns.svc[.cluster.local]   the service svc
+//	pod.svc.ns.svc[.cluster.local]            the pod named pod, e.g. a statefulset member
+//	name.ns.pod[.cluster.local]               the pod named name, or with the dashed IP name
+//	10.0.0.1                                  the pod with that IP
+func (s *SOCKS5Server) Resolve(ctx context.Context, host string, port int) (Proxy, error) {
+	host = strings.TrimSuffix(strings.TrimSuffix(host, "."), ".cluster.local")
+	if ip := net.ParseIP(host); ip != nil {
+		return s.resolvePodIP(ctx, "", ip.String(), port)
+	}
+	if strings.HasSuffix(host, ".pod") {
+		parts := strings.Split(strings.TrimSuffix(host, ".pod"), ".")
+		if len(parts) != 2 {
+			return Proxy{}, fmt.Errorf("cannot map host %s to a pod", host)
+		}
+		if ip := net.ParseIP(strings.ReplaceAll(parts[0], "-", ".")); ip != nil {
+			return s.resolvePodIP(ctx, parts[1], ip.String(), port)
+		}
+		return Proxy{Kind: "pods", ResourceName: parts[0], Namespace: parts[1], Port: port}, nil
+	}
+	// pods behind a service need the .svc suffix so that hosts such as example.com.au are not mapped to pods
+	if strings.HasSuffix(host, ".svc") {
+		if parts := strings.Split(strings.TrimSuffix(host, ".svc"), "."); len(parts) == 3 {
+			return Proxy{Kind: "pods", ResourceName: parts[0], Namespace: parts[2], Port: port}, nil
+		}
+	}
+	return ParseTarget(&url.URL{Host: net.JoinHostPort(host, strconv.Itoa(port))}, s.DefaultNamespace)
+}
+
+func (s *SOCKS5Server) resolvePodIP(ctx context.Context, namespace, ip string, port int) (Proxy, error) {
+	pods, err := s.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.podIP=" + ip,
+	})
+	if err != nil {
+		return Proxy{}, errors.Wrapf(err, "failed to find pod with ip %s", ip)
+	}
+	for _, pod := range pods.Items {
+		// host network pods report the node IP rather than their own, so they are skipped
+		if !pod.Spec.HostNetwork && isPodReady(pod) {
+			return Proxy{Kind: "pods", ResourceName: pod.Name, Namespace: pod.Namespace, Port: port}, nil
+		}
+	}
+	return Proxy{}, fmt.Errorf("no ready pod found with ip %s", ip)
+}
+
+// socksHandshake negotiates the no authentication method with the client
+func socksHandshake(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == socksNoAuth {
+			_, err := conn.Write([]byte{socksVersion, socksNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, socksNoAcceptable}) // nolint: errcheck
+	return fmt.Errorf("client does not support unauthenticated connections")
+}
+
+// readSocksRequest reads a CONNECT request, returning the requested host and port
+func readSocksRequest(conn net.Conn) (string, int, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	if header[1] != socksConnect {
+		writeSocksReply(conn, socksCommandNotSupported) // nolint: errcheck
+		return "", 0, fmt.Errorf("unsupported socks command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if header[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case socksDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(conn, socksAddressNotSupported) // nolint: errcheck
+		return "", 0, fmt.Errorf("unsupported socks address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// writeSocksReply writes a reply with an unspecified bind address, since the
+// port-forwarded connection has no meaningful local address
+func writeSocksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSOCKS5Resolve(t *testing.T) {
+	pod := newPod("web-1", true)
+	pod.Status.PodIP = "10.1.2.3"
+	s := NewSOCKS5Server(fake.NewSimpleClientset(pod), nil)
+
+	fixtures := []struct {
+		Host string
+		Kind string
+		Name string
+		NS   string
+	}{
+		{Host: "web", Kind: "services", Name: "web", NS: "default"},
+		{Host: "web.monitoring.svc.cluster.local", Kind: "services", Name: "web", NS: "monitoring"},
+		{Host: "web-0.web.monitoring.svc.cluster.local", Kind: "pods", Name: "web-0", NS: "monitoring"},
+		{Host: "web-0.monitoring.pod", Kind: "pods", Name: "web-0", NS: "monitoring"},
+	}
+	for _, host := range []string{"example.com.au", "web-0.web.monitoring"} {
+		if target, err := s.Resolve(context.Background(), host, 80); err == nil {
+			t.Errorf("%s: expected an error, got %+v", host, target)
+		}
+	}
+	for _, fixture := range fixtures {
+		target, err := s.Resolve(context.Background(), fixture.Host, 80)
+		if err != nil {
+			t.Errorf("%s: %v", fixture.Host, err)
+			continue
+		}
+		if normalizeKind(target.Kind) != fixture.Kind || target.ResourceName != fixture.Name || target.Namespace != fixture.NS {
+			t.Errorf("%s: unexpected target %+v", fixture.Host, target)
+		}
+	}
+}
+
+func TestSOCKS5Server(t *testing.T) {
+	echo := echoServer(t)
+	s := NewSOCKS5Server(fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+	}), nil)
+	var dialed Proxy
+	s.Dial = func(ctx context.Context, target Proxy) (net.Conn, error) {
+		dialed = target
+		return net.Dial("tcp", echo.Addr().String())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, listener) // nolint: errcheck
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dialSOCKS(t, conn, "web.default.svc.cluster.local", 8080)
+	if dialed.ResourceName != "web" || dialed.Namespace != "default" || dialed.Port != 8080 {
+		t.Errorf("unexpected target %+v", dialed)
+	}
+
+	conn.Write([]byte("ping\n")) // nolint: errcheck
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("expected ping, got %q: %v", line, err)
+	}
+}
+
+// dialSOCKS negotiates no authentication and connects to host:port
+func dialSOCKS(t *testing.T, conn net.Conn, host string, port uint16) {
+	conn.Write([]byte{0x05, 0x01, 0x00}) // nolint: errcheck
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("unexpected greeting reply %v: %v", reply, err)
+	}
+
+	request := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+	request = binary.BigEndian.AppendUint16(request, port)
+	conn.Write(request) // nolint: errcheck
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("unexpected connect reply %v: %v", reply, err)
+	}
+}
+
+func TestSOCKS5HalfClose(t *testing.T) {
+	server := drainServer(t)
+	s := NewSOCKS5Server(fake.NewSimpleClientset(), nil)
+	s.Dial = func(ctx context.Context, target Proxy) (net.Conn, error) {
+		return net.Dial("tcp", server.Addr().String())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, listener) // nolint: errcheck
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dialSOCKS(t, conn, "web", 80)
+	if response := halfClose(t, conn, "hello"); response != "read 5 bytes" {
+		t.Errorf("expected the response after a half-close, got %q", response)
+	}
+}
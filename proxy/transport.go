@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net/url"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// Transport is the streaming protocol used for port-forward and exec connections
+type Transport string
+
+const (
+	// TransportSPDY upgrades connections to SPDY/3.1, this is the default
+	TransportSPDY Transport = "spdy"
+	// TransportWebSocket tunnels port-forwarding over a WebSocket connection and
+	// uses the WebSocket remotecommand protocol for exec
+	TransportWebSocket Transport = "websocket"
+	// TransportAuto uses WebSocket, falling back to SPDY when the API server
+	// or a proxy in front of it does not support the WebSocket upgrade
+	TransportAuto Transport = "auto"
+)
+
+// ShouldFallback returns true if a WebSocket upgrade failed in a way that SPDY may succeed
+func ShouldFallback(err error) bool {
+	return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+}
+
+// WithTransport sets the streaming protocol used to upgrade port-forward connections
+func WithTransport(transport Transport) func(*Dialer) error {
+	return func(d *Dialer) error {
+		d.transport = transport
+		return nil
+	}
+}
+
+// upgradeWebSocket creates a SPDY connection tunneled over a WebSocket connection to u.
+// The WebSocket dialer does not accept a context, so a connection completed after ctx is done is closed
+func upgradeWebSocket(ctx context.Context, config *rest.Config, u *url.URL) (httpstream.Connection, error) {
+	dialer, err := portforward.NewSPDYOverWebsocketDialer(u, config)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		conn httpstream.Connection
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/flanksource/commons/console"
+	"github.com/flanksource/kommons/kustomize"
 	apps "k8s.io/api/apps/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -22,7 +23,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/tools/clientcmd"
 	"sigs.k8s.io/yaml"
 )
@@ -654,25 +654,10 @@ func (h Health) String() string {
 		h.RunningPods, console.Yellowf("%d", h.PendingPods), console.Redf("%d", h.CrashLoopBackOff), console.Redf("%d", h.ErrorPods), h.ReadyNodes, console.Redf("%d", h.UnreadyNodes))
 }
 
+// GetUnstructuredObjects decodes the objects in a stream of YAML or JSON documents,
+// decode errors include the line of the document that failed
 func GetUnstructuredObjects(data []byte) ([]*unstructured.Unstructured, error) {
-	var items []*unstructured.Unstructured
-	re := regexp.MustCompile("(?m)^---\\n")
-	for _, chunk := range re.Split(string(data), -1) {
-		if strings.TrimSpace(chunk) == "" {
-			continue
-		}
-
-		decoder := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader([]byte(chunk)), 1024)
-		var resource *unstructured.Unstructured
-
-		if err := decoder.Decode(&resource); err != nil {
-			return nil, fmt.Errorf("error decoding %s: %s", chunk, err)
-		}
-		if resource != nil {
-			items = append(items, resource)
-		}
-	}
-	return items, nil
+	return kustomize.NewDecoder(bytes.NewReader(data), "").DecodeAll()
 }
 
 func GetUnstructuredObjectsFromJson(data []byte) ([]*unstructured.Unstructured, error) {
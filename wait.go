@@ -687,6 +687,10 @@ func (c *Client) WaitForContainerStart(ns, name string, timeout time.Duration, c
 // WaitForPod waits for a pod to be in the specified phase, or returns an
 // error if the timeout is exceeded
 func (c *Client) WaitForPod(ns, name string, timeout time.Duration, phases ...v1.PodPhase) error {
+	return c.waitForPod(context.TODO(), ns, name, timeout, phases...)
+}
+
+func (c *Client) waitForPod(ctx context.Context, ns, name string, timeout time.Duration, phases ...v1.PodPhase) error {
 	if c.ApplyDryRun {
 		return nil
 	}
@@ -697,13 +701,20 @@ func (c *Client) WaitForPod(ns, name string, timeout time.Duration, phases ...v1
 	pods := client.CoreV1().Pods(ns)
 	start := time.Now()
 	for {
-		pod, err := pods.Get(context.TODO(), name, metav1.GetOptions{})
+		pod, err := pods.Get(ctx, name, metav1.GetOptions{})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if start.Add(timeout).Before(time.Now()) {
 			return fmt.Errorf("timeout exceeded waiting for %s is %s, error: %v", name, pod.Status.Phase, err)
 		}
 
 		if pod == nil || pod.Status.Phase == v1.PodPending {
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
 			continue
 		}
 		if pod.Status.Phase == v1.PodFailed {
@@ -6,7 +6,9 @@ import (
 	"strings"
 
 	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/kommons/kustomize"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
 )
 
 type Specs []Spec
@@ -15,15 +17,58 @@ type Spec struct {
 	Items []*unstructured.Unstructured
 }
 
+// WalkOption changes how Walk handles the files it finds
+type WalkOption func(*walkOptions)
+
+type walkOptions struct {
+	kustomizations bool
+}
+
+// BuildKustomizations makes Walk treat each directory containing a kustomization as a single unit,
+// the directory is built with kustomize and its output returned as one Spec instead of walking its files.
+// Kustomizations referenced by another kustomization in the tree, e.g. the base of an overlay,
+// are only built as part of the kustomizations that reference them
+func BuildKustomizations() WalkOption {
+	return func(o *walkOptions) {
+		o.kustomizations = true
+	}
+}
+
 // Walk iterates recursively over each file in path and
 // returns all of the objects contained
-func Walk(path string) (Specs, error) {
+func Walk(path string, options ...WalkOption) (Specs, error) {
+	opts := walkOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+	fs := filesys.MakeFsOnDisk()
+	var referenced map[string]bool
+	if opts.kustomizations {
+		var err error
+		if referenced, err = referencedKustomizations(fs, path); err != nil {
+			return nil, err
+		}
+	}
 	specs := Specs{}
 	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if info.IsDir() && opts.kustomizations && kustomize.IsKustomization(fs, path) {
+			if referenced[absPath(path)] {
+				return filepath.SkipDir
+			}
+			items, err := kustomize.Build(fs, path)
+			if err != nil {
+				return err
+			}
+			specs = append(specs, Spec{
+				Path:  path,
+				Items: items,
+			})
+			return filepath.SkipDir
+		}
 		if strings.HasSuffix(path, "kustomization.yaml") || strings.HasSuffix(path, "kustomization.yml") {
 			return nil
 		}
@@ -31,13 +76,14 @@ func Walk(path string) (Specs, error) {
 			return nil
 		}
 
-		data, err := os.ReadFile(path)
+		f, err := os.Open(path)
 		if err != nil {
 			return err
 		}
-		items, err := GetUnstructuredObjects(data)
+		defer f.Close()
+		items, err := kustomize.NewDecoder(f, path).DecodeAll()
 		if err != nil {
-			logger.Errorf("Error decoding %s: %v", path, err)
+			logger.Errorf("Error decoding %v", err)
 			return nil
 		}
 		items, err = Unwrap(items)
@@ -55,6 +101,33 @@ func Walk(path string) (Specs, error) {
 	return specs, err
 }
 
+// referencedKustomizations returns the absolute paths of the kustomizations that are
+// referenced by other kustomizations under root
+func referencedKustomizations(fs filesys.FileSystem, root string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || !kustomize.IsKustomization(fs, path) {
+			return err
+		}
+		references, err := kustomize.References(fs, path)
+		if err != nil {
+			return err
+		}
+		for _, reference := range references {
+			referenced[absPath(reference)] = true
+		}
+		return nil
+	})
+	return referenced, err
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
 func Unwrap(list []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
 	var items []*unstructured.Unstructured
 	for _, item := range list {
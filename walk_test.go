@@ -0,0 +1,109 @@
+package kommons
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWalkKustomizations(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"namespace.yaml": "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: app\n",
+		"base/kustomization.yaml": `
+resources:
+  - deployment.yaml
+configMapGenerator:
+  - name: settings
+    literals:
+      - key=value
+`,
+		"base/deployment.yaml": `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+        - name: web
+          image: nginx
+`,
+		"overlay/kustomization.yaml": `
+namePrefix: prod-
+resources:
+  - ../base
+components:
+  - ../component
+images:
+  - name: nginx
+    newTag: "1.21"
+`,
+		"component/kustomization.yaml": `
+apiVersion: kustomize.config.k8s.io/v1alpha1
+kind: Component
+labels:
+  - pairs:
+      env: prod
+`,
+	})
+
+	specs, err := Walk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected the namespace and base deployment files, got %d specs", len(specs))
+	}
+
+	specs, err = Walk(dir, BuildKustomizations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string][]string{}
+	for _, spec := range specs {
+		rel, _ := filepath.Rel(dir, spec.Path)
+		for _, item := range spec.Items {
+			found[rel] = append(found[rel], item.GetKind()+"/"+item.GetName())
+		}
+		sort.Strings(found[rel])
+	}
+	// namespace.yaml and the overlay, the base and component are only built as part of the overlay
+	if len(found) != 2 || found["namespace.yaml"][0] != "Namespace/app" {
+		t.Fatalf("unexpected specs: %v", found)
+	}
+	if !strings.HasPrefix(found["overlay"][0], "ConfigMap/prod-settings-") || found["overlay"][1] != "Deployment/prod-web" {
+		t.Errorf("unexpected overlay objects: %v", found["overlay"])
+	}
+
+	deployment := specs.FilterBy("Deployment")
+	if len(deployment) != 1 {
+		t.Fatalf("expected only the overlay's deployment, got %d", len(deployment))
+	}
+	for _, item := range deployment {
+		containers, _, _ := unstructured.NestedSlice(item.Object, "spec", "template", "spec", "containers")
+		if image := containers[0].(map[string]interface{})["image"]; image != "nginx:1.21" {
+			t.Errorf("expected the image to be overridden, got %s", image)
+		}
+		if item.GetLabels()["env"] != "prod" {
+			t.Errorf("expected the component to add labels, got %v", item.GetLabels())
+		}
+	}
+}